@@ -4,6 +4,7 @@ import "log"
 import "net/http"
 import "github.com/gorilla/websocket"
 import "github.com/msparks/iq/public"
+import "google.golang.org/protobuf/encoding/protojson"
 import "sync"
 
 var upgrader = websocket.Upgrader{
@@ -22,36 +23,55 @@ func serveWebsocket(s *EventServer, w http.ResponseWriter, r *http.Request) {
 	notifiee := s.NewNotifiee()
 	var wg sync.WaitGroup
 
-	// Relay events from the EventServer to the client.
+	// Relay events from the EventServer to the client. The writer reads from
+	// the notifiee until it is closed, even after the client has gone, since
+	// the EventServer blocks until every notifiee takes each event.
 	wg.Add(1)
 	go func() {
+		defer wg.Done()
+		failed := false
 		for {
 			t, ok := <-notifiee
 			if !ok {
 				log.Print("Notifiee closed. Writer returning.")
 				return
 			}
+			if failed {
+				continue
+			}
 			ev, ok := t.(*public.Event)
 			if !ok {
 				log.Print("Received unknown type, skipping.")
 				continue
 			}
 
-			if err = conn.WriteMessage(websocket.TextMessage, []byte(ev.String())); err != nil {
+			b, err := protojson.Marshal(ev)
+			if err != nil {
+				log.Print("Marshal error: ", err)
+				continue
+			}
+			if err = conn.WriteMessage(websocket.TextMessage, b); err != nil {
 				log.Print("WriteMessage error: ", err)
-				return
+				// Stop the reader, which closes the notifiee.
+				conn.Close()
+				failed = true
 			}
 		}
 	}()
 
-	// Read from the client.
+	// Read commands from the client, in the same JSON encoding as events.
 	for {
 		_, p, err := conn.ReadMessage()
 		if err != nil {
 			log.Print(err)
 			break
 		}
-		log.Printf("Message received from websocket: %s", string(p))
+		cmd := &public.Command{}
+		if err := protojson.Unmarshal(p, cmd); err != nil {
+			log.Printf("Invalid command from websocket: %s", err)
+			continue
+		}
+		s.Command <- cmd
 	}
 
 	// Kill writer.
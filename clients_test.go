@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"github.com/gorilla/websocket"
+	"github.com/msparks/iq/ircconnection"
+	"github.com/msparks/iq/ircsession"
+	"github.com/msparks/iq/public"
+	"google.golang.org/protobuf/encoding/protojson"
+	. "gopkg.in/check.v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ClientsTest struct{}
+
+var _ = Suite(&ClientsTest{})
+
+// Starts a session with its reactors, connected to a fake IRC server.
+// Returns the session and the server's end of the connection.
+func startSession(c *C, evs *EventServer) (*NamedSession, net.Conn, *bufio.Reader) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	endpoint := ircconnection.Endpoint{Address: listener.Addr().String()}
+	conn := ircconnection.NewIRCConnection([]ircconnection.Endpoint{endpoint})
+	conn.FloodControl = ircconnection.FloodControl{}
+	settings := ircsession.IRCSettings{
+		Nicknames: []string{"iq"},
+		User:      "iq",
+		Realname:  "IQ",
+	}
+	ns := &NamedSession{
+		Handle:  "h",
+		Conn:    conn,
+		Session: ircsession.NewIRCSession(settings, conn),
+	}
+	go ConnReactor(ns, evs)
+	go SessionReactor(ns, evs)
+	go CommandReactor(evs, ns)
+	go conn.StateIs(ircconnection.CONNECTING)
+
+	peer, err := listener.Accept()
+	c.Assert(err, IsNil)
+	return ns, peer, bufio.NewReader(peer)
+}
+
+func expectLine(c *C, r *bufio.Reader, line string) {
+	got, err := r.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Check(strings.TrimRight(got, "\r\n"), Equals, line)
+}
+
+func (s *ClientsTest) TestListRequest(c *C) {
+	evs := NewEventServer()
+	ns, peer, r := startSession(c, evs)
+	defer peer.Close()
+	defer ns.Conn.StateIs(ircconnection.DISCONNECTED)
+
+	expectLine(c, r, "NICK iq")
+	expectLine(c, r, "USER iq 0 * :IQ")
+	peer.Write([]byte(":irc.test 001 iq :Welcome\r\n"))
+	peer.Write([]byte(":iq!iq@host JOIN #iq\r\n"))
+	expectLine(c, r, "WHO #iq")
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			serveWebsocket(evs, w, r)
+		}))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	err = ws.WriteMessage(websocket.TextMessage,
+		[]byte(`{"listRequest": {"handle": "h", "channel": "#iq", "mode": "b"}}`))
+	c.Assert(err, IsNil)
+	expectLine(c, r, "MODE #iq +b")
+	peer.Write([]byte(":irc.test 367 iq #iq *!*@spam alice 1400000000\r\n"))
+	peer.Write([]byte(":irc.test 368 iq #iq :End of channel ban list\r\n"))
+
+	// Other events, such as the replies themselves, come first.
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, p, err := ws.ReadMessage()
+		c.Assert(err, IsNil)
+		ev := &public.Event{}
+		c.Assert(protojson.Unmarshal(p, ev), IsNil)
+		list := ev.GetChannelList()
+		if list == nil {
+			continue
+		}
+		c.Check(list.GetHandle(), Equals, "h")
+		c.Check(list.GetChannel(), Equals, "#iq")
+		c.Check(list.GetMode(), Equals, "b")
+		c.Assert(list.GetEntries(), HasLen, 1)
+		c.Check(list.GetEntries()[0].GetMask(), Equals, "*!*@spam")
+		c.Check(list.GetEntries()[0].GetSetBy(), Equals, "alice")
+		c.Check(list.GetEntries()[0].GetSetAt(), Equals, int64(1400000000))
+		break
+	}
+}
+
+func (s *ClientsTest) TestClientGoneWhileEventsFlow(c *C) {
+	evs := NewEventServer()
+	done := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			serveWebsocket(evs, w, r)
+			done <- true
+		}))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	c.Assert(err, IsNil)
+
+	// Keep events coming until the client has gone.
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case evs.Event <- &public.Event{}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// The client goes away mid-stream, without a close frame.
+	_, _, err = ws.ReadMessage()
+	c.Assert(err, IsNil)
+	ws.UnderlyingConn().(*net.TCPConn).SetLinger(0)
+	ws.Close()
+
+	// The handler returns and the EventServer still takes events.
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		c.Fatal("Handler did not return")
+	}
+	stop <- true
+	for i := 0; i < 10; i++ {
+		select {
+		case evs.Event <- &public.Event{}:
+		case <-time.After(2 * time.Second):
+			c.Fatal("EventServer is wedged")
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import "github.com/msparks/iq/public"
+import "log"
 
 func CommandReactor(evs *EventServer, ns *NamedSession) {
 	notifiee := evs.NewNotifiee()
@@ -14,7 +15,22 @@ func CommandReactor(evs *EventServer, ns *NamedSession) {
 			if ircMsg != nil && ircMsg.GetHandle() == ns.Handle {
 				msg := ircMsg.GetMessage()
 				if msg != nil {
-					ns.Conn.OutgoingMessageIs(msg)
+					// The session splits messages too long for one line.
+					if err := ns.Session.Send(msg); err != nil {
+						log.Printf("Error sending command: %s", err)
+					}
+				}
+			}
+
+			req := v.GetListRequest()
+			if req != nil && req.GetHandle() == ns.Handle {
+				// The list arrives as a session notification; see
+				// SessionReactor.
+				mode := req.GetMode()
+				if len(mode) != 1 {
+					log.Printf("Invalid list mode: %q", mode)
+				} else if err := ns.Session.RequestList(req.GetChannel(), mode[0]); err != nil {
+					log.Printf("Error requesting list: %s", err)
 				}
 			}
 		}
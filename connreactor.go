@@ -1,8 +1,8 @@
 package main
 
-import "code.google.com/p/goprotobuf/proto"
 import "github.com/msparks/iq/ircconnection"
 import "github.com/msparks/iq/public"
+import "time"
 
 func ConnReactor(ns *NamedSession, evs *EventServer) {
 	notifiee := ns.Conn.NewNotifiee()
@@ -13,10 +13,20 @@ func ConnReactor(ns *NamedSession, evs *EventServer) {
 		switch v := v.(type) {
 		case ircconnection.IncomingMessageNotification:
 			ev := &public.Event{
-				IrcMessage: &public.IrcMessage{
-					Handle: proto.String(ns.Handle),
+				Payload: &public.Event_IrcMessage{IrcMessage: &public.IrcMessage{
+					Handle: ns.Handle,
 					Message: v.Message,
-				},
+				}},
+				Timestamp: v.Time.UnixNano() / int64(time.Microsecond),
+			}
+			evs.Event <-ev
+		case ircconnection.LagNotification:
+			ev := &public.Event{
+				Payload: &public.Event_Lag{Lag: &public.Lag{
+					Handle: ns.Handle,
+					Milliseconds: int64(v.Lag / time.Millisecond),
+				}},
+				Timestamp: time.Now().UnixNano() / int64(time.Microsecond),
 			}
 			evs.Event <-ev
 		}
@@ -0,0 +1,12 @@
+module github.com/msparks/iq
+
+go 1.23
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	google.golang.org/protobuf v1.36.9
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
+	gopkg.in/gcfg.v1 v1.2.3
+)
+
+require gopkg.in/warnings.v0 v0.1.2 // indirect
@@ -1,6 +1,6 @@
 package main
 
-import "code.google.com/p/gcfg"
+import "gopkg.in/gcfg.v1"
 import "github.com/msparks/iq/ircconnection"
 import "github.com/msparks/iq/ircsession"
 import "io"
@@ -17,13 +17,47 @@ type Config struct {
 }
 
 type NetworkConfig struct {
-	Nick   string
-	Server string
-	// TODO(msparks): Multiple servers on the same network?
+	// Nicknames in order of preference. Repeat the variable to list
+	// alternates to try when the first is taken.
+	Nick []string
+
+	// IRCv3 capabilities to request. Repeat for more than one.
+	Capability []string
+
+	// SASL authentication. See ircsession.IRCSettings.
+	SASLMechanism string
+	SASLAccount   string
+	SASLPassword  string
+	SASLOptional  bool
+
+	// Get the primary nick back when it frees up. See ircsession.IRCSettings.
+	ReclaimNick    bool
+	NickServRegain bool
+
+	// Reply to CTCP VERSION. See ircsession.IRCSettings.
+	CTCPVersion string
+
+	// Servers are tried in order. Repeat the variable to list more than one.
+	Server []string
+
+	// TLS settings, applied to every server on the network. See
+	// ircconnection.Endpoint.
+	TLS                   bool
+	TLSServerName         string
+	TLSCAFile             string
+	TLSInsecureSkipVerify bool
+	TLSFingerprint        string
+
+	// Client certificate for CertFP. TLSKeyFile defaults to TLSCertFile.
+	TLSCertFile string
+	TLSKeyFile  string
 }
 
 type ChannelConfig struct {
 	Label []string
+
+	// Channel key (mode +k), if any.
+	Key string
 }
 
 type Network struct {
@@ -109,13 +143,45 @@ func main() {
 	// Create a session for each of the configured networks.
 	var sessions []*NamedSession
 	for _, network := range networks {
-		endpoint := ircconnection.Endpoint{Address: network.Config.Server}
-		conn := ircconnection.NewIRCConnection([]ircconnection.Endpoint{endpoint})
+		if len(network.Config.Server) == 0 {
+			log.Fatalf("Network '%s' has no servers.", network.Name)
+		}
+		if len(network.Config.Nick) == 0 {
+			log.Fatalf("Network '%s' has no nicknames.", network.Name)
+		}
+		var endpoints []ircconnection.Endpoint
+		for _, server := range network.Config.Server {
+			endpoints = append(endpoints, ircconnection.Endpoint{
+				Address:            server,
+				TLS:                network.Config.TLS,
+				ServerName:         network.Config.TLSServerName,
+				CAFile:             network.Config.TLSCAFile,
+				InsecureSkipVerify: network.Config.TLSInsecureSkipVerify,
+				Fingerprint:        network.Config.TLSFingerprint,
+				CertFile:           network.Config.TLSCertFile,
+				KeyFile:            network.Config.TLSKeyFile,
+			})
+		}
+		conn := ircconnection.NewIRCConnection(endpoints)
 
 		settings := ircsession.IRCSettings{
-			Nicknames: []string{network.Config.Nick},
+			Nicknames: network.Config.Nick,
 			User: "IQ",
 			Realname: "IQ",
+			Capabilities: network.Config.Capability,
+			SASLMechanism: network.Config.SASLMechanism,
+			SASLAccount: network.Config.SASLAccount,
+			SASLPassword: network.Config.SASLPassword,
+			SASLOptional: network.Config.SASLOptional,
+			ReclaimNick: network.Config.ReclaimNick,
+			NickServRegain: network.Config.NickServRegain,
+			CTCPVersion: network.Config.CTCPVersion,
+		}
+		for _, channel := range network.Channels {
+			settings.Channels = append(settings.Channels, ircsession.AutoJoinChannel{
+				Name: channel.Name,
+				Key: channel.Config.Key,
+			})
 		}
 		session := ircsession.NewIRCSession(settings, conn)
 
@@ -127,6 +193,7 @@ func main() {
 		}
 
 		go ConnReactor(ns, eventServer)
+		go SessionReactor(ns, eventServer)
 		go CommandReactor(eventServer, ns)
 
 		conn.StateIs(ircconnection.CONNECTING)
@@ -0,0 +1,79 @@
+package ircconnection
+
+import (
+	ircproto "github.com/msparks/iq/public/irc"
+	"time"
+)
+
+// Limits the rate of outgoing messages so the server does not disconnect us
+// for flooding. Each message costs Interval plus ByteInterval for each byte
+// sent, and up to Burst messages' worth of cost may be sent at once. This is
+// the scheme servers use to penalize clients (RFC 1459 section 8.10). The
+// zero value disables flood control.
+type FloodControl struct {
+	Burst        int
+	Interval     time.Duration
+	ByteInterval time.Duration
+}
+
+// The FloodControl of new IRCConnections.
+var DefaultFloodControl = FloodControl{
+	Burst:        5,
+	Interval:     2 * time.Second,
+	ByteInterval: 2 * time.Second / 120,
+}
+
+// Tracks how far ahead of real time our sending is.
+type limiter struct {
+	FloodControl
+
+	// The time at which all sent messages will have been paid for.
+	next time.Time
+}
+
+// Returns how long to wait before sending n bytes.
+func (l *limiter) wait(now time.Time, n int) time.Duration {
+	if l.Interval <= 0 && l.ByteInterval <= 0 {
+		// Disabled.
+		return 0
+	}
+	burst := l.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	next := l.next
+	if next.Before(now) {
+		next = now
+	}
+	// The window is the cost of a burst of messages with no bytes.
+	wait := next.Add(l.cost(n)).Sub(now) - time.Duration(burst)*l.Interval
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Records that n bytes were sent.
+func (l *limiter) take(now time.Time, n int) {
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(l.cost(n))
+}
+
+func (l *limiter) cost(n int) time.Duration {
+	return l.Interval + time.Duration(n)*l.ByteInterval
+}
+
+// Returns whether a message bypasses flood control. These are needed to
+// register and stay connected, and the server does not penalize them much.
+// They still count against the limit of other messages.
+func isPriority(p *ircproto.Message) bool {
+	switch p.GetPayload().(type) {
+	case *ircproto.Message_Ping, *ircproto.Message_Pong, *ircproto.Message_Nick,
+		*ircproto.Message_User, *ircproto.Message_Cap,
+		*ircproto.Message_Authenticate:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package ircconnection
+
+import (
+	"bufio"
+	ircproto "github.com/msparks/iq/public/irc"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type FloodTest struct{}
+
+var _ = Suite(&FloodTest{})
+
+func (s *FloodTest) TestLimiter(c *C) {
+	l := &limiter{FloodControl: FloodControl{Burst: 3, Interval: time.Second}}
+	now := time.Unix(1000, 0)
+
+	// A burst goes out at once.
+	for i := 0; i < 3; i++ {
+		c.Check(l.wait(now, 10), Equals, time.Duration(0))
+		l.take(now, 10)
+	}
+
+	// Then one per interval.
+	c.Check(l.wait(now, 10), Equals, time.Second)
+	now = now.Add(time.Second)
+	c.Check(l.wait(now, 10), Equals, time.Duration(0))
+	l.take(now, 10)
+	c.Check(l.wait(now, 10), Equals, time.Second)
+
+	// Credit builds back up while idle, but not beyond the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		c.Check(l.wait(now, 10), Equals, time.Duration(0))
+		l.take(now, 10)
+	}
+	c.Check(l.wait(now, 10), Equals, time.Second)
+}
+
+func (s *FloodTest) TestLimiterBytes(c *C) {
+	l := &limiter{FloodControl: FloodControl{
+		Burst:        2,
+		Interval:     time.Second,
+		ByteInterval: 10 * time.Millisecond,
+	}}
+	now := time.Unix(1000, 0)
+
+	// Long messages cost more.
+	c.Check(l.wait(now, 100), Equals, time.Duration(0))
+	l.take(now, 100)
+	c.Check(l.wait(now, 0), Equals, time.Second)
+	c.Check(l.wait(now, 100), Equals, 2*time.Second)
+}
+
+func (s *FloodTest) TestLimiterDisabled(c *C) {
+	l := &limiter{}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 100; i++ {
+		c.Check(l.wait(now, 500), Equals, time.Duration(0))
+		l.take(now, 500)
+	}
+}
+
+func (s *FloodTest) TestPriority(c *C) {
+	server := localServer(c)
+	defer server.Close()
+
+	ic := NewIRCConnection([]Endpoint{{Address: server.Addr().String()}})
+	ic.FloodControl = FloodControl{Burst: 1, Interval: 100 * time.Millisecond}
+	c.Assert(ic.StateIs(CONNECTING), IsNil)
+	notifiee := ic.NewNotifiee()
+
+	peer, err := server.Accept()
+	c.Assert(err, IsNil)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+	<-notifiee  // CONNECTED
+
+	for _, text := range []string{"one", "two", "three"} {
+		privmsg := &ircproto.Message{
+			Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+				Target:  "#chan",
+				Message: text,
+			}},
+		}
+		c.Assert(ic.OutgoingMessageIs(privmsg), IsNil)
+	}
+	pong := &ircproto.Message{
+		Payload: &ircproto.Message_Pong{Pong: &ircproto.Pong{Target: "x"}},
+	}
+	c.Assert(ic.OutgoingMessageIs(pong), IsNil)
+
+	// The PONG jumps the queue and the PRIVMSGs are paced.
+	reader := bufio.NewReader(peer)
+	start := time.Now()
+	var lines []string
+	for i := 0; i < 4; i++ {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		lines = append(lines, line)
+	}
+	// The first PRIVMSG may or may not beat it.
+	if lines[0] == "PONG :x\r\n" {
+		lines[0], lines[1] = lines[1], lines[0]
+	}
+	c.Check(lines, DeepEquals, []string{
+		"PRIVMSG #chan :one\r\n",
+		"PONG :x\r\n",
+		"PRIVMSG #chan :two\r\n",
+		"PRIVMSG #chan :three\r\n",
+	})
+	c.Check(time.Since(start) >= 150*time.Millisecond, Equals, true)
+
+	shutDown(c, ic, notifiee)
+}
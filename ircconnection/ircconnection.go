@@ -5,6 +5,8 @@
 package ircconnection
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
 	"github.com/msparks/iq/notify"
 	ircproto "github.com/msparks/iq/public/irc"
@@ -12,6 +14,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -30,6 +33,30 @@ const (
 type Endpoint struct {
 	// net.Dial format.
 	Address string
+
+	// Connect with TLS.
+	TLS bool
+
+	// Name to verify the server certificate against. Defaults to the host in
+	// Address.
+	ServerName string
+
+	// PEM file of CA certificates used to verify the server instead of the
+	// system roots.
+	CAFile string
+
+	// Accept any server certificate. Insecure; for testing only.
+	InsecureSkipVerify bool
+
+	// Hex-encoded SHA-256 fingerprint of the server certificate, with or
+	// without colons. If set, the certificate must match it and the chain is
+	// not verified.
+	Fingerprint string
+
+	// PEM files of a client certificate and its key to present to the
+	// server, for CertFP or SASL EXTERNAL. KeyFile defaults to CertFile.
+	CertFile string
+	KeyFile  string
 }
 
 // IRCConnection is a state machine for a connection to an IRC network. Its
@@ -42,27 +69,118 @@ type IRCConnection struct {
 	Endpoints []Endpoint
 	Err       error
 
+	// If non-empty, a QUIT with this message is sent before the socket is
+	// closed by StateIs(DISCONNECTED).
+	QuitMessage string
+
+	// A PING is sent after PingInterval without hearing from the server, and
+	// the connection is closed with ErrPingTimeout if there is no reply
+	// within PingTimeout. Zero disables the check.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// Pacing of outgoing messages. Changes take effect on the next
+	// connection.
+	FloodControl FloodControl
+
+	// Capacity of the outgoing queue, and what to do when it is full. Changes
+	// to QueueSize take effect on the next connection.
+	QueueSize    int
+	QueuePolicy  QueuePolicy
+	QueueTimeout time.Duration
+
 	state State
+
+	// Index into Endpoints of the server in use or being dialed. Guarded by mu.
+	endpoint int
+
+	// Fingerprints of the certificates exchanged on the current connection,
+	// if it uses TLS. Guarded by mu.
+	fingerprint       string
+	clientFingerprint string
+
 	wg    sync.WaitGroup
 	mu    sync.Mutex
 	conn  *irc.Conn
 
-	out chan *ircproto.Message
+	// Reads the same socket as conn. We parse lines ourselves so that the
+	// original line is available.
+	reader *bufio.Reader
+
+	// Outgoing queues. Messages from priority bypass flood control.
+	out      chan *ircproto.Message
+	priority chan *ircproto.Message
+
+	// Closed by StateIs(DISCONNECTED) to stop the writer.
+	quit chan struct{}
+
+	// Closed when the current connection is finished with, to stop the writer
+	// and anyone waiting to queue a message.
+	done chan struct{}
+
+	// Outgoing queue metrics. Guarded by mu.
+	dropped  int
+	rejected int
+
+	// True once the current connection has started shutting down. No more
+	// messages are accepted by OutgoingMessageIs. Guarded by mu.
+	closing bool
+
+	// Liveness checking. pingToken is the token of the outstanding PING, if
+	// any. Guarded by mu.
+	lastRead     time.Time
+	pingToken    string
+	pingSent     time.Time
+	pingSeq      int
+	lag          time.Duration
+	pingTimedOut bool
 }
 
 // Delivered to notifiees when the IRC connection state changes.
-type StateChangeNotification struct{}
+type StateChangeNotification struct {
+	// The new state.
+	State State
+
+	// Why the connection was lost, for a change to DISCONNECTED. Nil if it
+	// was shut down by StateIs(DISCONNECTED). See IRCConnection.Err.
+	Err error
+
+	// The server in use, or the one that will be dialed next.
+	Endpoint Endpoint
+}
+
+// Delivered to notifiees when a TLS handshake completes, before the state
+// changes to CONNECTED.
+type PeerCertificateNotification struct {
+	Endpoint Endpoint
+
+	// Hex-encoded SHA-256 fingerprint of the server certificate.
+	Fingerprint string
+
+	// Hex-encoded SHA-256 fingerprint of the client certificate offered to
+	// the server, or empty if none.
+	ClientFingerprint string
+}
 
 // Delivered to notifiees when an IRC message is received from the connection.
 type IncomingMessageNotification struct {
 	Message *ircproto.Message
+
+	// When the server says it sent the message, from the server-time tag, or
+	// else when we received it.
+	Time time.Time
 }
 
 // Initializes a DISCONNECTED IRCConnection.
 func NewIRCConnection(endpoints []Endpoint) *IRCConnection {
 	ic := &IRCConnection{
-		Endpoints: endpoints,
-		state:     DISCONNECTED,
+		Endpoints:    endpoints,
+		PingInterval: DefaultPingInterval,
+		PingTimeout:  DefaultPingTimeout,
+		FloodControl: DefaultFloodControl,
+		QueueSize:    DefaultQueueSize,
+		QueueTimeout: DefaultQueueTimeout,
+		state:        DISCONNECTED,
 	}
 	return ic
 }
@@ -70,11 +188,17 @@ func NewIRCConnection(endpoints []Endpoint) *IRCConnection {
 // Returns a new IRCConnection from a ReadWriteCloser. Initial state is CONNECTED.
 func FromRWC(c io.ReadWriteCloser, endpoints []Endpoint) *IRCConnection {
 	ic := &IRCConnection{
-		Endpoints: endpoints,
-		state:     CONNECTED,
-		conn:      irc.NewConn(c),
+		Endpoints:    endpoints,
+		PingInterval: DefaultPingInterval,
+		PingTimeout:  DefaultPingTimeout,
+		FloodControl: DefaultFloodControl,
+		QueueSize:    DefaultQueueSize,
+		QueueTimeout: DefaultQueueTimeout,
+		state:        CONNECTED,
+		conn:         irc.NewConn(c),
+		reader:       bufio.NewReader(c),
 	}
-	go ic.run()
+	ic.start()
 	return ic
 }
 
@@ -85,12 +209,33 @@ func (ic *IRCConnection) State() State {
 	return ic.state
 }
 
+// Returns the server in use, or the one that will be dialed next.
+func (ic *IRCConnection) Endpoint() Endpoint {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.currentEndpoint()
+}
+
+// Returns the hex-encoded SHA-256 fingerprint of the server certificate, or
+// empty if the connection does not use TLS.
+func (ic *IRCConnection) PeerFingerprint() string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.fingerprint
+}
+
 // Changes the State of the connection.
 //
 // Allowed transitions:
 //
 //   DISCONNECTED -> CONNECTING
 //   CONNECTED -> DISCONNECTED
+//
+// A transition to DISCONNECTED blocks until the connection is closed and the
+// final StateChangeNotification has been delivered. A transition to
+// CONNECTING first waits for the previous connection to finish the same way.
+// So neither may be called from a goroutine that receives this
+// IRCConnection's notifications.
 func (ic *IRCConnection) StateIs(s State) error {
 	ic.mu.Lock()
 	defer ic.mu.Unlock()
@@ -102,19 +247,39 @@ func (ic *IRCConnection) StateIs(s State) error {
 
 	switch s {
 	case DISCONNECTED:
-		// Shut down.
-		return errors.New("Disconnection unimplemented.")
+		if ic.state != CONNECTED || ic.closing {
+			return errors.New("Invalid transition")
+		}
+		// Shut down. The writer sends QUIT and closes the socket, which stops
+		// the reader. run() then changes the state and notifies.
+		ic.closing = true
+		close(ic.quit)
+		ic.mu.Unlock()
+		ic.wg.Wait()
+		ic.mu.Lock()
 
 	case CONNECTING:
 		if ic.state == CONNECTED {
 			return errors.New("Invalid transition")
 		}
+		// Let the last connection deliver its final notification first, so
+		// that notifications arrive in order.
+		ic.mu.Unlock()
+		ic.wg.Wait()
+		ic.mu.Lock()
+		if ic.state != DISCONNECTED {
+			// Someone else started connecting meanwhile.
+			return nil
+		}
+
 		// Start connecting.
 		ic.Err = nil
 		ic.state = s
-		ic.Notify(StateChangeNotification{})
-		ic.wg.Add(1)
-		go ic.run()
+		n := ic.stateChange()
+		ic.mu.Unlock()
+		ic.Notify(n)
+		ic.mu.Lock()
+		ic.start()
 
 	case CONNECTED:
 		return errors.New("Invalid transition")
@@ -123,105 +288,317 @@ func (ic *IRCConnection) StateIs(s State) error {
 	return nil
 }
 
+// Queues a message to be sent. Returns an error if the message is invalid,
+// or ErrQueueFull if the outgoing queue is full, depending on QueuePolicy.
 func (ic *IRCConnection) OutgoingMessageIs(p *ircproto.Message) error {
-	ic.mu.Lock()
-	defer ic.mu.Unlock()
-	if ic.state != CONNECTED {
-		return errors.New("Not connected")
+	return ic.enqueue(p)
+}
+
+// Returns the current endpoint. ic.mu must be held.
+func (ic *IRCConnection) currentEndpoint() Endpoint {
+	if len(ic.Endpoints) == 0 {
+		return Endpoint{}
 	}
-	ic.out <- p
-	return nil
+	return ic.Endpoints[ic.endpoint%len(ic.Endpoints)]
+}
+
+// Moves on to the next endpoint, wrapping around. ic.mu must be held.
+func (ic *IRCConnection) nextEndpoint() {
+	if len(ic.Endpoints) > 0 {
+		ic.endpoint = (ic.endpoint + 1) % len(ic.Endpoints)
+	}
+}
+
+// Returns a StateChangeNotification for the current state. ic.mu must be
+// held, but not while the notification is delivered: notifiees may call
+// methods that take it.
+func (ic *IRCConnection) stateChange() StateChangeNotification {
+	return StateChangeNotification{
+		State:    ic.state,
+		Err:      ic.Err,
+		Endpoint: ic.currentEndpoint(),
+	}
+}
+
+// Starts the goroutine for a new connection. ic.mu must be held.
+func (ic *IRCConnection) start() {
+	size := ic.QueueSize
+	if size < 0 {
+		size = 0
+	}
+	ic.out = make(chan *ircproto.Message, size)
+	ic.priority = make(chan *ircproto.Message, size)
+	ic.quit = make(chan struct{})
+	ic.done = make(chan struct{})
+	ic.closing = false
+	ic.wg.Add(1)
+	go ic.run()
 }
 
 func (ic *IRCConnection) run() {
-	ic.out = make(chan *ircproto.Message)
-	defer close(ic.out)
+	defer ic.wg.Done()
 
 	// Do we need to connect?
 	if ic.conn == nil {
 		err := ic.connect()
 		if err != nil {
+			log.Printf("IRCConnection error connecting: %s", err)
 			ic.mu.Lock()
-			defer ic.mu.Unlock()
 			ic.state = DISCONNECTED
 			ic.Err = err
-			ic.Notify(StateChangeNotification{})
-			log.Printf("IRCConnection error connecting: %s", err)
+			n := ic.stateChange()
+			ic.mu.Unlock()
+			ic.Notify(n)
 			return
 		}
 	}
 
 	// We're connected.
 	ic.mu.Lock()
+	var ns []interface{}
+	if ic.fingerprint != "" {
+		ns = append(ns, PeerCertificateNotification{
+			Endpoint:          ic.currentEndpoint(),
+			Fingerprint:       ic.fingerprint,
+			ClientFingerprint: ic.clientFingerprint,
+		})
+	}
 	ic.state = CONNECTED
-	ic.Notify(StateChangeNotification{})
+	ns = append(ns, ic.stateChange())
 	ic.mu.Unlock()
+	for _, n := range ns {
+		ic.Notify(n)
+	}
 
-	// Use the connection until it dies.
+	// Use the connection until it dies or we are asked to shut down.
 	err := ic.readAndWrite()
-	log.Printf("IRCConnection error: %s", err)
+	if err != nil {
+		log.Printf("IRCConnection error: %s", err)
+	} else {
+		log.Print("IRCConnection disconnected.")
+	}
 
 	ic.mu.Lock()
-	defer ic.mu.Unlock()
 	ic.state = DISCONNECTED
 	ic.Err = err
 	ic.conn.Close()
 	ic.conn = nil
-	ic.Notify(StateChangeNotification{})
+	ic.reader = nil
+	ic.fingerprint, ic.clientFingerprint = "", ""
+	if err != nil {
+		// Try a different server next time.
+		ic.nextEndpoint()
+	}
+	n := ic.stateChange()
+	ic.mu.Unlock()
+	ic.Notify(n)
 }
 
+// Dials each endpoint in turn, starting with the current one, until one
+// succeeds. Returns the last error if they all fail.
 func (ic *IRCConnection) connect() error {
-	log.Print("IRCConnection connecting...")
+	if len(ic.Endpoints) == 0 {
+		return errors.New("No endpoints")
+	}
 
-	endpoint := ic.Endpoints[0]
 	dialer := &net.Dialer{
 		KeepAlive: 10 * time.Second,
 	}
-	sock, err := dialer.Dial("tcp", endpoint.Address)
-	if err != nil {
-		return err
-	}
-	ic.conn = irc.NewConn(sock)
 
-	log.Print("IRCConnection connected.")
+	var err error
+	for i := 0; i < len(ic.Endpoints); i++ {
+		ic.mu.Lock()
+		endpoint := ic.currentEndpoint()
+		ic.mu.Unlock()
+
+		log.Printf("IRCConnection connecting to %s...", endpoint.Address)
+		var sock net.Conn
+		var config *tls.Config
+		sock, config, err = dial(dialer, endpoint)
+		if err == nil {
+			ic.mu.Lock()
+			ic.fingerprint, ic.clientFingerprint = fingerprints(sock, config)
+			ic.mu.Unlock()
+			ic.conn = irc.NewConn(sock)
+			ic.reader = bufio.NewReader(sock)
+			log.Print("IRCConnection connected.")
+			return nil
+		}
+		log.Printf("IRCConnection error connecting to %s: %s",
+			endpoint.Address, err)
 
-	return nil
+		ic.mu.Lock()
+		ic.nextEndpoint()
+		ic.mu.Unlock()
+	}
+
+	return err
 }
 
-// Reads ic.conn indefinitely.
+// Reads and writes ic.conn until it dies or is shut down. The returned error
+// is nil if the shutdown was requested with StateIs(DISCONNECTED).
 func (ic *IRCConnection) readAndWrite() error {
+	ic.mu.Lock()
+	ic.resetPing()
+	ic.mu.Unlock()
+
+	var writer sync.WaitGroup
+	writer.Add(2)
 	go func() {
-		for {
-			p, ok := <-ic.out
-			if !ok {
-				return
+		defer writer.Done()
+		ic.write()
+	}()
+	pingDone := make(chan struct{})
+	go func() {
+		defer writer.Done()
+		ic.ping(pingDone)
+	}()
+
+	err := ic.read()
+
+	// Stop the writer and pinger.
+	ic.mu.Lock()
+	ic.closing = true
+	close(ic.done)
+	close(pingDone)
+	timedOut := ic.pingTimedOut
+	ic.mu.Unlock()
+	writer.Wait()
+
+	select {
+	case <-ic.quit:
+		// We closed the socket ourselves; the read error is expected.
+		return nil
+	default:
+		if timedOut {
+			return ErrPingTimeout
+		}
+		return err
+	}
+}
+
+// Writes outgoing messages to ic.conn until ic.done is closed or a shutdown is
+// requested. Messages are paced according to ic.FloodControl, except for
+// priority messages, which are sent right away.
+func (ic *IRCConnection) write() {
+	limiter := &limiter{FloodControl: ic.FloodControl}
+
+	// A message taken from ic.out that is waiting for the limiter, and its
+	// tags. We only take one at a time so that ic.out stays bounded.
+	var held *irc.Message
+	var heldTags map[string]string
+
+	for {
+		// Priority messages go first.
+		select {
+		case p := <-ic.priority:
+			ic.writePriority(limiter, p)
+			continue
+		default:
+		}
+
+		var out <-chan *ircproto.Message
+		var ready <-chan time.Time
+		if held == nil {
+			out = ic.out
+		} else {
+			now := time.Now()
+			wait := limiter.wait(now, held.Len())
+			if wait == 0 {
+				ic.encode(held, heldTags)
+				limiter.take(now, held.Len())
+				held, heldTags = nil, nil
+				continue
 			}
+			ready = time.After(wait)
+		}
+
+		select {
+		case p := <-ic.priority:
+			ic.writePriority(limiter, p)
 
+		case p := <-out:
 			msg, err := protoAsMessage(p)
 			if err != nil {
 				log.Printf("Ignoring outgoing message: %+v", p)
 				continue
 			}
-			log.Printf("Sending message: %+v", p)
-			err = ic.conn.Encode(msg)
-			if err != nil {
-				log.Printf("Error sending message: %s", err)
+			held, heldTags = msg, p.GetTags()
+
+		case <-ready:
+
+		case <-ic.done:
+			return
+
+		case <-ic.quit:
+			if ic.QuitMessage != "" {
+				msg := &irc.Message{Command: irc.QUIT, Trailing: ic.QuitMessage}
+				if err := ic.conn.Encode(msg); err != nil {
+					log.Printf("Error sending QUIT: %s", err)
+				}
 			}
+			// Unblocks the reader.
+			ic.conn.Close()
+			return
 		}
-	}()
+	}
+}
+
+// Sends a priority message right away, charging it to the limiter.
+func (ic *IRCConnection) writePriority(limiter *limiter, p *ircproto.Message) {
+	msg, err := protoAsMessage(p)
+	if err != nil {
+		log.Printf("Ignoring outgoing message: %+v", p)
+		return
+	}
+	ic.encode(msg, p.GetTags())
+	limiter.take(time.Now(), msg.Len())
+}
+
+// Writes a message with optional tags to ic.conn, logging failures.
+func (ic *IRCConnection) encode(msg *irc.Message, tags map[string]string) {
+	line := msg.String()
+	if len(tags) > 0 {
+		line = "@" + formatTags(tags) + " " + line
+	}
+	log.Printf("Sending message: %s", line)
+	if _, err := ic.conn.Write([]byte(line)); err != nil {
+		log.Printf("Error sending message: %s", err)
+	}
+}
 
+// Reads ic.conn until it fails.
+func (ic *IRCConnection) read() error {
 	for {
-		message, err := ic.conn.Decode()
+		line, err := ic.reader.ReadString('\n')
 		if err != nil {
 			return err
 		}
+		received := time.Now()
+		line = strings.TrimRight(line, "\r\n")
+		tags, rest := splitTags(line)
+		message := irc.ParseMessage(rest)
+		if message == nil {
+			log.Printf("IRCConnection ignoring line: %q", line)
+			continue
+		}
+		ic.onRead(message)
 
 		p, err := messageAsProto(message)
 		if err != nil {
-			log.Printf("IRCConnection ignoring message: %+v", message)
-			continue
+			// Pass it on as is, rather than losing it.
+			log.Printf("IRCConnection passing on message as RAW (%s): %+v",
+				err, message)
+			p = rawProto(message)
+		}
+		if raw := p.GetRaw(); raw != nil {
+			raw.Line = &line
 		}
+		p.Tags = tags
 
-		ic.Notify(IncomingMessageNotification{Message: p})
+		ic.Notify(IncomingMessageNotification{
+			Message: p,
+			Time:    messageTime(tags, received),
+		})
 	}
 }
@@ -2,12 +2,13 @@ package ircconnection
 
 import (
 	"bufio"
-	"code.google.com/p/goprotobuf/proto"
 	ircproto "github.com/msparks/iq/public/irc"
 	. "gopkg.in/check.v1"
 	"io"
 	"net"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -26,7 +27,7 @@ func localServer(c *C) net.Listener {
 }
 
 func (s *IRCConnectionTest) TestNewIRCConnection(c *C) {
-	ep := Endpoint{"some server"}
+	ep := Endpoint{Address: "some server"}
 	ic := NewIRCConnection([]Endpoint{ep})
 
 	c.Check(ic.State(), Equals, DISCONNECTED)
@@ -42,7 +43,7 @@ func (s *IRCConnectionTest) TestFromRWC(c *C) {
 	c.Assert(err, IsNil)
 
 	// Create an IRCConnection from the established connection.
-	ep := Endpoint{"some server"}
+	ep := Endpoint{Address: "some server"}
 	ic := FromRWC(conn, []Endpoint{ep})
 
 	c.Check(ic.State(), Equals, CONNECTED)
@@ -51,7 +52,7 @@ func (s *IRCConnectionTest) TestFromRWC(c *C) {
 func (s *IRCConnectionTest) TestConnect(c *C) {
 	server := localServer(c)
 
-	ep := Endpoint{server.Addr().String()}
+	ep := Endpoint{Address: server.Addr().String()}
 	ic := NewIRCConnection([]Endpoint{ep})
 
 	// Start connecting. Our server won't accept the connection until we
@@ -63,9 +64,9 @@ func (s *IRCConnectionTest) TestConnect(c *C) {
 	// Accept the connection. The state changes asynchronously, so we use
 	// notifications to wait for it.
 	notifiee := ic.NewNotifiee()
-	defer ic.CloseNotifiee(notifiee)
 	peer, err := server.Accept()
 	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
 	c.Assert(err, IsNil)
 	<-notifiee
 	c.Check(ic.State(), Equals, CONNECTED)
@@ -74,7 +75,7 @@ func (s *IRCConnectionTest) TestConnect(c *C) {
 func (s *IRCConnectionTest) TestRead(c *C) {
 	server := localServer(c)
 
-	ep := Endpoint{server.Addr().String()}
+	ep := Endpoint{Address: server.Addr().String()}
 	ic := NewIRCConnection([]Endpoint{ep})
 	c.Assert(ic.StateIs(CONNECTING), IsNil)
 
@@ -92,25 +93,56 @@ func (s *IRCConnectionTest) TestRead(c *C) {
 		v := <-notifiee
 		switch v := v.(type) {
 		case IncomingMessageNotification:
-			c.Assert(v.Message.GetType(), Equals, ircproto.Message_PING)
+			c.Assert(v.Message.GetPing(), NotNil)
 			return
 		}
 	}
 }
 
+func (s *IRCConnectionTest) TestReadRaw(c *C) {
+	server := localServer(c)
+
+	ep := Endpoint{Address: server.Addr().String()}
+	ic := NewIRCConnection([]Endpoint{ep})
+	c.Assert(ic.StateIs(CONNECTING), IsNil)
+
+	notifiee := ic.NewNotifiee()
+	defer ic.CloseNotifiee(notifiee)
+
+	// Unknown and malformed commands are passed on with the original line.
+	go func() {
+		peer, _ := server.Accept()
+		io.WriteString(peer, ":irc.test  WALLOPS  :hi\r\n")
+		io.WriteString(peer, ":alice!a@host KICK #iq\r\n")
+	}()
+
+	var lines []string
+	for len(lines) < 2 {
+		v := <-notifiee
+		switch v := v.(type) {
+		case IncomingMessageNotification:
+			c.Assert(v.Message.GetRaw(), NotNil)
+			lines = append(lines, v.Message.GetRaw().GetLine())
+		}
+	}
+	c.Check(lines, DeepEquals, []string{
+		":irc.test  WALLOPS  :hi",
+		":alice!a@host KICK #iq",
+	})
+}
+
 func (s *IRCConnectionTest) TestWrite(c *C) {
 	server := localServer(c)
 
-	ep := Endpoint{server.Addr().String()}
+	ep := Endpoint{Address: server.Addr().String()}
 	ic := NewIRCConnection([]Endpoint{ep})
 	c.Assert(ic.StateIs(CONNECTING), IsNil)
 
 	pong := &ircproto.Message{
-		Type: ircproto.Message_PONG.Enum(),
-		Pong: &ircproto.Pong{
-			Source: proto.String("source"),
-			Target: proto.String("target"),
-		},
+		Payload: &ircproto.Message_Pong{Pong: &ircproto.Pong{
+			Source: "source",
+			Target: "target",
+		}},
 	}
 
 	// Can't send messages yet; we're not connected.
@@ -137,7 +169,7 @@ func (s *IRCConnectionTest) TestWrite(c *C) {
 func (s *IRCConnectionTest) TestRemoteDisconnect(c *C) {
 	server := localServer(c)
 
-	ep := Endpoint{server.Addr().String()}
+	ep := Endpoint{Address: server.Addr().String()}
 	ic := NewIRCConnection([]Endpoint{ep})
 	c.Assert(ic.StateIs(CONNECTING), IsNil)
 
@@ -159,7 +191,7 @@ func (s *IRCConnectionTest) TestRemoteDisconnect(c *C) {
 func (s *IRCConnectionTest) TestReconnect(c *C) {
 	server := localServer(c)
 
-	ep := Endpoint{server.Addr().String()}
+	ep := Endpoint{Address: server.Addr().String()}
 	ic := NewIRCConnection([]Endpoint{ep})
 	c.Assert(ic.StateIs(CONNECTING), IsNil)
 
@@ -185,3 +217,214 @@ func (s *IRCConnectionTest) TestReconnect(c *C) {
 
 	c.Check(ic.State(), Equals, CONNECTED)
 }
+
+func (s *IRCConnectionTest) TestDisconnect(c *C) {
+	server := localServer(c)
+
+	ep := Endpoint{Address: server.Addr().String()}
+	ic := NewIRCConnection([]Endpoint{ep})
+	ic.QuitMessage = "Leaving"
+	c.Assert(ic.StateIs(CONNECTING), IsNil)
+
+	notifiee := ic.NewNotifiee()
+	defer ic.CloseNotifiee(notifiee)
+
+	peer, _ := server.Accept()
+	defer peer.Close()
+	<-notifiee  // CONNECTED
+
+	// Shut down. StateIs blocks until the final notification is delivered.
+	done := make(chan error)
+	go func() {
+		done <- ic.StateIs(DISCONNECTED)
+	}()
+	<-notifiee  // DISCONNECTED
+	c.Assert(<-done, IsNil)
+
+	c.Check(ic.State(), Equals, DISCONNECTED)
+	c.Check(ic.Err, IsNil)
+
+	// Can't send messages after disconnecting.
+	c.Check(ic.OutgoingMessageIs(&ircproto.Message{}), ErrorMatches,
+		"Not connected")
+
+	// The peer sees QUIT and then EOF.
+	reader := bufio.NewReader(peer)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Check(line, Equals, "QUIT :Leaving\r\n")
+	_, err = reader.ReadString('\n')
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *IRCConnectionTest) TestDisconnectWithoutQuit(c *C) {
+	server := localServer(c)
+
+	ep := Endpoint{Address: server.Addr().String()}
+	ic := NewIRCConnection([]Endpoint{ep})
+	c.Assert(ic.StateIs(CONNECTING), IsNil)
+
+	notifiee := ic.NewNotifiee()
+	defer ic.CloseNotifiee(notifiee)
+
+	peer, _ := server.Accept()
+	defer peer.Close()
+	<-notifiee  // CONNECTED
+
+	go ic.StateIs(DISCONNECTED)
+	<-notifiee  // DISCONNECTED
+
+	// No QUIT is sent without a QuitMessage.
+	reader := bufio.NewReader(peer)
+	_, err := reader.ReadString('\n')
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *IRCConnectionTest) TestDisconnectInvalidTransition(c *C) {
+	server := localServer(c)
+
+	ep := Endpoint{Address: server.Addr().String()}
+	ic := NewIRCConnection([]Endpoint{ep})
+
+	// Already disconnected.
+	c.Check(ic.StateIs(DISCONNECTED), IsNil)
+
+	// Can't disconnect while connecting.
+	notifiee := ic.NewNotifiee()
+	go ic.StateIs(CONNECTING)
+	<-notifiee  // CONNECTING
+	c.Check(ic.StateIs(DISCONNECTED), ErrorMatches, "Invalid transition")
+
+	peer, _ := server.Accept()
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+	<-notifiee  // CONNECTED
+}
+
+func (s *IRCConnectionTest) TestDisconnectNoGoroutineLeak(c *C) {
+	server := localServer(c)
+	defer server.Close()
+
+	before := runtime.NumGoroutine()
+
+	ep := Endpoint{Address: server.Addr().String()}
+	ic := NewIRCConnection([]Endpoint{ep})
+	notifiee := ic.NewNotifiee()
+	go ic.StateIs(CONNECTING)
+	<-notifiee  // CONNECTING
+	peer, _ := server.Accept()
+	<-notifiee  // CONNECTED
+
+	go ic.StateIs(DISCONNECTED)
+	<-notifiee  // DISCONNECTED
+	ic.CloseNotifiee(notifiee)
+	peer.Close()
+
+	// Goroutines may take a moment to exit after the notification.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(runtime.NumGoroutine() <= before, Equals, true)
+}
+
+// Returns the address of a local port that refuses connections.
+func deadAddress(c *C) string {
+	server := localServer(c)
+	addr := server.Addr().String()
+	server.Close()
+	return addr
+}
+
+func (s *IRCConnectionTest) TestConnectFailover(c *C) {
+	server := localServer(c)
+
+	dead := Endpoint{Address: deadAddress(c)}
+	live := Endpoint{Address: server.Addr().String()}
+	ic := NewIRCConnection([]Endpoint{dead, live})
+	c.Check(ic.Endpoint(), Equals, dead)
+
+	notifiee := ic.NewNotifiee()
+	go ic.StateIs(CONNECTING)
+	<-notifiee  // CONNECTING
+
+	// The first endpoint refuses the connection, so the second is dialed.
+	peer, err := server.Accept()
+	c.Assert(err, IsNil)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+	v := (<-notifiee).(StateChangeNotification)
+	c.Check(v.State, Equals, CONNECTED)
+	c.Check(ic.State(), Equals, CONNECTED)
+	c.Check(v.Endpoint, Equals, live)
+	c.Check(ic.Endpoint(), Equals, live)
+}
+
+func (s *IRCConnectionTest) TestConnectAllEndpointsFail(c *C) {
+	ep1 := Endpoint{Address: deadAddress(c)}
+	ep2 := Endpoint{Address: deadAddress(c)}
+	ic := NewIRCConnection([]Endpoint{ep1, ep2})
+
+	notifiee := ic.NewNotifiee()
+	defer ic.CloseNotifiee(notifiee)
+	go ic.StateIs(CONNECTING)
+	<-notifiee  // CONNECTING
+	v := (<-notifiee).(StateChangeNotification)
+
+	c.Check(v.State, Equals, DISCONNECTED)
+	c.Check(v.Err, NotNil)
+	c.Check(ic.State(), Equals, DISCONNECTED)
+	c.Check(ic.Err, Equals, v.Err)
+	// Every endpoint was tried, so we are back at the first.
+	c.Check(ic.Endpoint(), Equals, ep1)
+}
+
+func (s *IRCConnectionTest) TestRepeatedConnectFailures(c *C) {
+	ic := NewIRCConnection([]Endpoint{{Address: deadAddress(c)}})
+	notifiee := ic.NewNotifiee()
+	defer ic.CloseNotifiee(notifiee)
+
+	// Notifiees may call back into the connection, as IRCSession does,
+	// while the refusal is waiting to be delivered.
+	for i := 0; i < 5; i++ {
+		go ic.StateIs(CONNECTING)
+		v := (<-notifiee).(StateChangeNotification)
+		c.Check(v.State, Equals, CONNECTING)
+		time.Sleep(10 * time.Millisecond)
+		ic.State()  // Must not block.
+		v = (<-notifiee).(StateChangeNotification)
+		c.Assert(v.State, Equals, DISCONNECTED)
+		c.Check(v.Err, NotNil)
+		c.Check(ic.State(), Equals, DISCONNECTED)
+	}
+}
+
+func (s *IRCConnectionTest) TestReconnectRotatesEndpoints(c *C) {
+	server1 := localServer(c)
+	server2 := localServer(c)
+
+	ep1 := Endpoint{Address: server1.Addr().String()}
+	ep2 := Endpoint{Address: server2.Addr().String()}
+	ic := NewIRCConnection([]Endpoint{ep1, ep2})
+
+	notifiee := ic.NewNotifiee()
+	go ic.StateIs(CONNECTING)
+	<-notifiee  // CONNECTING
+	peer, _ := server1.Accept()
+	<-notifiee  // CONNECTED
+	c.Check(ic.Endpoint(), Equals, ep1)
+
+	// A remote disconnect moves on to the next server.
+	peer.Close()
+	v := (<-notifiee).(StateChangeNotification)  // DISCONNECTED
+	c.Check(v.Endpoint, Equals, ep2)
+
+	go ic.StateIs(CONNECTING)
+	<-notifiee  // CONNECTING
+	peer, err := server2.Accept()
+	c.Assert(err, IsNil)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+	<-notifiee  // CONNECTED
+	c.Check(ic.Endpoint(), Equals, ep2)
+}
@@ -0,0 +1,23 @@
+package ircconnection
+
+// Numerics not defined by the irc package, named as in the IRCv3 and
+// modern IRC client protocol documents.
+const (
+	RPL_ISUPPORT     = "005"
+	RPL_WHOISACCOUNT = "330"
+	RPL_TOPICWHOTIME = "333"
+	RPL_WHOSPCRPL    = "354"
+	ERR_NOMOTD       = "422"
+	RPL_MONONLINE    = "730"
+	RPL_MONOFFLINE   = "731"
+	ERR_MONLISTFULL  = "734"
+	RPL_LOGGEDIN     = "900"
+	RPL_LOGGEDOUT    = "901"
+	ERR_NICKLOCKED   = "902"
+	RPL_SASLSUCCESS  = "903"
+	ERR_SASLFAIL     = "904"
+	ERR_SASLTOOLONG  = "905"
+	ERR_SASLABORTED  = "906"
+	ERR_SASLALREADY  = "907"
+	RPL_SASLMECHS    = "908"
+)
@@ -0,0 +1,142 @@
+package ircconnection
+
+import (
+	"errors"
+	"fmt"
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"log"
+	"time"
+)
+
+// Defaults for IRCConnection.PingInterval and PingTimeout.
+const (
+	DefaultPingInterval = 90 * time.Second
+	DefaultPingTimeout  = 120 * time.Second
+)
+
+// The error in IRCConnection.Err when the server stopped responding.
+var ErrPingTimeout = errors.New("Ping timeout")
+
+// Delivered to notifiees each time the round-trip time to the server is
+// measured.
+type LagNotification struct {
+	Endpoint Endpoint
+	Lag      time.Duration
+}
+
+// Returns the last measured round-trip time to the server, or zero if it has
+// not been measured on the current connection.
+func (ic *IRCConnection) Lag() time.Duration {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.lag
+}
+
+// Resets the liveness state for a new connection. ic.mu must be held.
+func (ic *IRCConnection) resetPing() {
+	ic.lastRead = time.Now()
+	ic.pingToken = ""
+	ic.lag = 0
+	ic.pingTimedOut = false
+}
+
+// Records that something was read from the server. If it is the PONG to our
+// outstanding PING, the lag is measured and notified.
+func (ic *IRCConnection) onRead(message *irc.Message) {
+	ic.mu.Lock()
+	now := time.Now()
+	ic.lastRead = now
+	if message.Command != irc.PONG || ic.pingToken == "" ||
+		pongToken(message) != ic.pingToken {
+		ic.mu.Unlock()
+		return
+	}
+	ic.pingToken = ""
+	ic.lag = now.Sub(ic.pingSent)
+	n := LagNotification{Endpoint: ic.currentEndpoint(), Lag: ic.lag}
+	ic.mu.Unlock()
+
+	ic.Notify(n)
+}
+
+// Returns the token echoed in a PONG. It follows the server name, usually but
+// not always as the trailing parameter.
+func pongToken(message *irc.Message) string {
+	if message.Trailing != "" || len(message.Params) < 2 {
+		return message.Trailing
+	}
+	return message.Params[len(message.Params)-1]
+}
+
+// Sends a PING when the connection has been idle for PingInterval, and closes
+// it if nothing is heard back within PingTimeout. Returns when done is closed.
+func (ic *IRCConnection) ping(done <-chan struct{}) {
+	if ic.PingInterval <= 0 || ic.PingTimeout <= 0 {
+		// Disabled.
+		return
+	}
+
+	for {
+		wait, ping := ic.checkLiveness()
+		if wait == 0 {
+			return
+		}
+		if ping != nil {
+			if err := ic.enqueue(ping); err != nil {
+				log.Printf("IRCConnection error sending PING: %s", err)
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+	}
+}
+
+// Declares the connection dead or returns a PING to send, as needed. Also
+// returns how long to wait before checking again, or zero if the connection
+// is being closed.
+func (ic *IRCConnection) checkLiveness() (time.Duration, *ircproto.Message) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if ic.closing {
+		return 0, nil
+	}
+
+	now := time.Now()
+	if ic.pingToken != "" {
+		// Any traffic shows the server is alive, even if the PONG is slow.
+		since := ic.pingSent
+		if ic.lastRead.After(since) {
+			since = ic.lastRead
+		}
+		if remaining := ic.PingTimeout - now.Sub(since); remaining > 0 {
+			return remaining, nil
+		}
+		if ic.lastRead.Before(ic.pingSent) {
+			log.Printf("IRCConnection ping timeout after %s.", ic.PingTimeout)
+			ic.pingTimedOut = true
+			// Unblocks the reader, which shuts everything else down.
+			ic.conn.Close()
+			return 0, nil
+		}
+		// The server is talking but lost our PING. Start over.
+		ic.pingToken = ""
+	}
+
+	idle := now.Sub(ic.lastRead)
+	if idle < ic.PingInterval {
+		return ic.PingInterval - idle, nil
+	}
+
+	ic.pingSeq++
+	ic.pingToken = fmt.Sprintf("iq-%d", ic.pingSeq)
+	ic.pingSent = now
+	ping := &ircproto.Message{
+		Payload: &ircproto.Message_Ping{Ping: &ircproto.Ping{Target: ic.pingToken}},
+	}
+	return ic.PingTimeout, ping
+}
@@ -0,0 +1,144 @@
+package ircconnection
+
+import (
+	"bufio"
+	"github.com/msparks/iq/notify"
+	. "gopkg.in/check.v1"
+	"io"
+	"strings"
+	"time"
+)
+
+type PingTest struct{}
+
+var _ = Suite(&PingTest{})
+
+// Returns a CONNECTED connection with short ping settings, a notifiee for it,
+// and its peer.
+func pingConnection(c *C) (*IRCConnection, notify.Notifiee, *bufio.Reader, io.WriteCloser) {
+	server := localServer(c)
+	defer server.Close()
+
+	ic := NewIRCConnection([]Endpoint{{Address: server.Addr().String()}})
+	ic.PingInterval = 50 * time.Millisecond
+	ic.PingTimeout = 100 * time.Millisecond
+	c.Assert(ic.StateIs(CONNECTING), IsNil)
+	notifiee := ic.NewNotifiee()
+
+	peer, err := server.Accept()
+	c.Assert(err, IsNil)
+	<-notifiee  // CONNECTED
+	return ic, notifiee, bufio.NewReader(peer), peer
+}
+
+// Shuts down ic, discarding notifications until it is done.
+func shutDown(c *C, ic *IRCConnection, notifiee notify.Notifiee) {
+	done := make(chan error)
+	go func() {
+		done <- ic.StateIs(DISCONNECTED)
+	}()
+	for {
+		select {
+		case <-notifiee:
+		case err := <-done:
+			c.Check(err, IsNil)
+			return
+		}
+	}
+}
+
+func (s *PingTest) TestLag(c *C) {
+	ic, notifiee, reader, peer := pingConnection(c)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+
+	// The idle connection is pinged.
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(line, "PING :"), Equals, true)
+	token := strings.TrimSpace(strings.TrimPrefix(line, "PING :"))
+
+	time.Sleep(10 * time.Millisecond)
+	io.WriteString(peer, ":irc.test PONG irc.test :"+token+"\r\n")
+	for {
+		v := <-notifiee
+		if v, ok := v.(LagNotification); ok {
+			c.Check(v.Lag >= 10*time.Millisecond, Equals, true)
+			c.Check(ic.Lag(), Equals, v.Lag)
+			break
+		}
+	}
+
+	// A PONG with the wrong token is not a measurement.
+	line, err = reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	io.WriteString(peer, ":irc.test PONG irc.test :bogus\r\n")
+	for {
+		v := <-notifiee
+		c.Check(v, Not(FitsTypeOf), LagNotification{})
+		if v, ok := v.(IncomingMessageNotification); ok &&
+			v.Message.GetPong().GetTarget() == "bogus" {
+			break
+		}
+	}
+	c.Check(ic.State(), Equals, CONNECTED)
+	shutDown(c, ic, notifiee)
+}
+
+func (s *PingTest) TestTimeout(c *C) {
+	ic, notifiee, reader, peer := pingConnection(c)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+
+	// Ignore the PING. The connection is declared dead.
+	_, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	for ic.State() == CONNECTED {
+		<-notifiee
+	}
+	c.Check(ic.State(), Equals, DISCONNECTED)
+	c.Check(ic.Err, Equals, ErrPingTimeout)
+}
+
+func (s *PingTest) TestTrafficKeepsAlive(c *C) {
+	ic, notifiee, reader, peer := pingConnection(c)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+	go func() {
+		for range notifiee {
+		}
+	}()
+
+	// The PING is lost, but the server keeps talking, so the connection stays
+	// up and is pinged again.
+	_, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			io.WriteString(peer, "NOTICE iq :hello\r\n")
+			time.Sleep(20 * time.Millisecond)
+		}
+		close(done)
+	}()
+	<-done
+	c.Check(ic.State(), Equals, CONNECTED)
+	c.Check(ic.StateIs(DISCONNECTED), IsNil)
+}
+
+func (s *PingTest) TestDisabled(c *C) {
+	server := localServer(c)
+	defer server.Close()
+
+	ic := NewIRCConnection([]Endpoint{{Address: server.Addr().String()}})
+	ic.PingInterval = 0
+	c.Assert(ic.StateIs(CONNECTING), IsNil)
+	peer, err := server.Accept()
+	c.Assert(err, IsNil)
+	defer peer.Close()
+
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = bufio.NewReader(peer).ReadString('\n')
+	c.Check(err, Not(IsNil))
+	c.Check(ic.StateIs(DISCONNECTED), IsNil)
+}
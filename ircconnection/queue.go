@@ -0,0 +1,129 @@
+package ircconnection
+
+import (
+	"errors"
+	ircproto "github.com/msparks/iq/public/irc"
+	"time"
+)
+
+// What OutgoingMessageIs does when the outgoing queue is full.
+type QueuePolicy int
+
+const (
+	// Wait up to QueueTimeout for space, or indefinitely if it is zero.
+	QueueBlock QueuePolicy = iota
+
+	// Discard the oldest queued message to make room.
+	QueueDropOldest
+
+	// Fail immediately.
+	QueueReject
+)
+
+// Defaults for IRCConnection.QueueSize and QueueTimeout.
+const (
+	DefaultQueueSize    = 256
+	DefaultQueueTimeout = 5 * time.Second
+)
+
+// Returned by OutgoingMessageIs when the message could not be queued because
+// the queue is full.
+var ErrQueueFull = errors.New("Outgoing queue full")
+
+// Outgoing queue metrics.
+type QueueStats struct {
+	// Messages waiting to be sent on the current connection.
+	Depth int
+
+	// Messages discarded by QueueDropOldest, and messages refused with
+	// ErrQueueFull, over the lifetime of the IRCConnection.
+	Dropped  int
+	Rejected int
+}
+
+// Returns the outgoing queue metrics.
+func (ic *IRCConnection) QueueStats() QueueStats {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return QueueStats{
+		Depth:    len(ic.out) + len(ic.priority),
+		Dropped:  ic.dropped,
+		Rejected: ic.rejected,
+	}
+}
+
+// Queues p for the writer according to ic.QueuePolicy. ic.mu must not be
+// held, since this may block.
+func (ic *IRCConnection) enqueue(p *ircproto.Message) error {
+	ic.mu.Lock()
+	if ic.state != CONNECTED || ic.closing {
+		ic.mu.Unlock()
+		return errors.New("Not connected")
+	}
+	lane := ic.out
+	if isPriority(p) {
+		lane = ic.priority
+	}
+	done := ic.done
+	ic.mu.Unlock()
+
+	if _, err := protoAsMessage(p); err != nil {
+		return err
+	}
+
+	switch ic.QueuePolicy {
+	case QueueDropOldest:
+		for {
+			select {
+			case lane <- p:
+				return nil
+			case <-done:
+				return errors.New("Not connected")
+			default:
+			}
+			if cap(lane) == 0 {
+				// Nothing to drop.
+				break
+			}
+			select {
+			case <-lane:
+				ic.count(&ic.dropped)
+			default:
+			}
+		}
+
+	case QueueReject:
+		select {
+		case lane <- p:
+			return nil
+		case <-done:
+			return errors.New("Not connected")
+		default:
+		}
+
+	default:
+		var timeout <-chan time.Time
+		if ic.QueueTimeout > 0 {
+			timer := time.NewTimer(ic.QueueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case lane <- p:
+			return nil
+		case <-done:
+			return errors.New("Not connected")
+		case <-timeout:
+		}
+	}
+
+	ic.count(&ic.rejected)
+	return ErrQueueFull
+}
+
+// Increments a counter guarded by ic.mu.
+func (ic *IRCConnection) count(n *int) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	*n++
+}
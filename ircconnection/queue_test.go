@@ -0,0 +1,124 @@
+package ircconnection
+
+import (
+	"bufio"
+	"github.com/msparks/iq/notify"
+	ircproto "github.com/msparks/iq/public/irc"
+	. "gopkg.in/check.v1"
+	"net"
+	"time"
+)
+
+type QueueTest struct{}
+
+var _ = Suite(&QueueTest{})
+
+func privmsg(text string) *ircproto.Message {
+	return &ircproto.Message{
+		Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+			Target:  "#chan",
+			Message: text,
+		}},
+	}
+}
+
+// Returns a CONNECTED connection with a full outgoing queue of size 2. Flood
+// control holds up the writer after the first message.
+func fullQueue(c *C, policy QueuePolicy) (*IRCConnection, notify.Notifiee, net.Conn) {
+	server := localServer(c)
+	defer server.Close()
+
+	ic := NewIRCConnection([]Endpoint{{Address: server.Addr().String()}})
+	ic.FloodControl = FloodControl{Burst: 1, Interval: time.Hour}
+	ic.QueueSize = 2
+	ic.QueuePolicy = policy
+	ic.QueueTimeout = 50 * time.Millisecond
+	c.Assert(ic.StateIs(CONNECTING), IsNil)
+	notifiee := ic.NewNotifiee()
+
+	peer, err := server.Accept()
+	c.Assert(err, IsNil)
+	<-notifiee  // CONNECTED
+
+	// The first message is sent and the second is held by the writer.
+	c.Assert(ic.OutgoingMessageIs(privmsg("one")), IsNil)
+	line, err := bufio.NewReader(peer).ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "PRIVMSG #chan :one\r\n")
+	c.Assert(ic.OutgoingMessageIs(privmsg("two")), IsNil)
+	for ic.QueueStats().Depth != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Assert(ic.OutgoingMessageIs(privmsg("three")), IsNil)
+	c.Assert(ic.OutgoingMessageIs(privmsg("four")), IsNil)
+	c.Assert(ic.QueueStats().Depth, Equals, 2)
+	return ic, notifiee, peer
+}
+
+func (s *QueueTest) TestReject(c *C) {
+	ic, notifiee, peer := fullQueue(c, QueueReject)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+
+	c.Check(ic.OutgoingMessageIs(privmsg("five")), Equals, ErrQueueFull)
+	c.Check(ic.QueueStats(), Equals, QueueStats{Depth: 2, Rejected: 1})
+
+	// Priority messages have their own lane.
+	pong := &ircproto.Message{
+		Payload: &ircproto.Message_Pong{Pong: &ircproto.Pong{Target: "x"}},
+	}
+	c.Check(ic.OutgoingMessageIs(pong), IsNil)
+
+	shutDown(c, ic, notifiee)
+}
+
+func (s *QueueTest) TestDropOldest(c *C) {
+	ic, notifiee, peer := fullQueue(c, QueueDropOldest)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+
+	c.Check(ic.OutgoingMessageIs(privmsg("five")), IsNil)
+	c.Check(ic.OutgoingMessageIs(privmsg("six")), IsNil)
+	c.Check(ic.QueueStats(), Equals, QueueStats{Depth: 2, Dropped: 2})
+	c.Check(<-ic.out, DeepEquals, privmsg("five"))
+
+	shutDown(c, ic, notifiee)
+}
+
+func (s *QueueTest) TestBlock(c *C) {
+	ic, notifiee, peer := fullQueue(c, QueueBlock)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+
+	start := time.Now()
+	c.Check(ic.OutgoingMessageIs(privmsg("five")), Equals, ErrQueueFull)
+	c.Check(time.Since(start) >= ic.QueueTimeout, Equals, true)
+	c.Check(ic.QueueStats().Rejected, Equals, 1)
+
+	// Without a timeout, the caller waits until the connection goes away.
+	// Meanwhile, other callers are not held up.
+	ic.QueueTimeout = 0
+	done := make(chan error)
+	go func() {
+		done <- ic.OutgoingMessageIs(privmsg("five"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(ic.State(), Equals, CONNECTED)
+	shutDown(c, ic, notifiee)
+	c.Check(<-done, ErrorMatches, "Not connected")
+}
+
+func (s *QueueTest) TestInvalidMessage(c *C) {
+	ic, notifiee, peer := fullQueue(c, QueueReject)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+
+	// Invalid messages are refused up front rather than dropped by the
+	// writer.
+	c.Check(ic.OutgoingMessageIs(&ircproto.Message{}), ErrorMatches,
+		"Unknown message type")
+	c.Check(ic.QueueStats(), Equals, QueueStats{Depth: 2})
+
+	shutDown(c, ic, notifiee)
+}
@@ -0,0 +1,270 @@
+package ircconnection
+
+import (
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"strconv"
+	"strings"
+)
+
+// Fills in the named fields of reply for the numerics we know. params are
+// all the parameters of the reply, starting with our nick. Replies with too
+// few parameters are left alone.
+func setReplyDetails(reply *ircproto.Reply, params []string) {
+	n := len(params)
+	switch reply.GetNumeric() {
+	case irc.RPL_WELCOME:
+		// <client> :<message>
+		if n < 1 {
+			return
+		}
+		welcome := &ircproto.Welcome{Nick: params[0]}
+		if n > 1 {
+			welcome.Message = params[n-1]
+		}
+		reply.Details = &ircproto.Reply_Welcome{Welcome: welcome}
+
+	case RPL_ISUPPORT:
+		// <client> <tokens>... :are supported by this server
+		// Some servers leave out the text. Tokens never contain spaces.
+		if n < 2 {
+			return
+		}
+		tokens := params[1:]
+		if last := params[n-1]; last == "" || strings.Contains(last, " ") {
+			tokens = params[1 : n-1]
+		}
+		reply.Details = &ircproto.Reply_Isupport{
+			Isupport: parseISupport(tokens)}
+
+	case irc.RPL_MOTDSTART, irc.RPL_MOTD, irc.RPL_ENDOFMOTD:
+		// <client> :- <line>
+		motd := &ircproto.Motd{}
+		if reply.GetNumeric() == irc.RPL_MOTD && n > 1 {
+			line := strings.TrimPrefix(params[n-1], "-")
+			motd.Line = strings.TrimPrefix(line, " ")
+		}
+		reply.Details = &ircproto.Reply_Motd{Motd: motd}
+
+	case irc.RPL_NAMREPLY:
+		// <client> <symbol> <channel> :<names>
+		// Some servers leave out the symbol.
+		if n < 3 {
+			return
+		}
+		names := &ircproto.NamesReply{
+			Channel: params[n-2],
+			Names:   strings.Fields(params[n-1]),
+		}
+		if n > 3 {
+			names.Visibility = params[1]
+		}
+		reply.Details = &ircproto.Reply_Names{Names: names}
+
+	case irc.RPL_WHOREPLY:
+		// <client> <channel> <user> <host> <server> <nick> <flags>
+		//   :<hops> <realname>
+		if n < 8 {
+			return
+		}
+		hops, realname := params[7], ""
+		if i := strings.IndexByte(hops, ' '); i >= 0 {
+			hops, realname = hops[:i], hops[i+1:]
+		}
+		who := &ircproto.WhoReply{
+			Channel:  params[1],
+			User:     params[2],
+			Host:     params[3],
+			Server:   params[4],
+			Nick:     params[5],
+			Flags:    params[6],
+			Realname: realname,
+		}
+		if h, err := strconv.ParseInt(hops, 10, 32); err == nil {
+			who.Hops = int32(h)
+		}
+		reply.Details = &ircproto.Reply_Who{Who: who}
+
+	case irc.RPL_WHOISUSER, irc.RPL_WHOISSERVER, irc.RPL_WHOISOPERATOR,
+		irc.RPL_WHOISIDLE, irc.RPL_WHOISCHANNELS, RPL_WHOISACCOUNT:
+		if whois := whoisReply(reply.GetNumeric(), params); whois != nil {
+			reply.Details = &ircproto.Reply_Whois{Whois: whois}
+		}
+
+	case irc.RPL_NOTOPIC, irc.RPL_TOPIC, RPL_TOPICWHOTIME:
+		if topic := topicReply(reply.GetNumeric(), params); topic != nil {
+			reply.Details = &ircproto.Reply_Topic{Topic: topic}
+		}
+
+	case irc.RPL_BANLIST, irc.RPL_EXCEPTLIST, irc.RPL_INVITELIST:
+		// <client> <channel> <mask> [<who> <set-ts>]
+		if n < 3 {
+			return
+		}
+		entry := &ircproto.ListEntry{Channel: params[1], Mask: params[2]}
+		if n > 4 {
+			entry.SetBy = params[3]
+			entry.SetAt = parseInt64(params[4])
+		}
+		reply.Details = &ircproto.Reply_ListEntry{ListEntry: entry}
+
+	case irc.RPL_ENDOFWHO, irc.RPL_ENDOFWHOIS, irc.RPL_ENDOFINVITELIST,
+		irc.RPL_ENDOFEXCEPTLIST, irc.RPL_ENDOFNAMES, irc.RPL_ENDOFBANLIST:
+		// <client> <target> :<message>
+		if n < 2 {
+			return
+		}
+		end := &ircproto.EndOfList{Target: params[1]}
+		if n > 2 {
+			end.Message = params[n-1]
+		}
+		reply.Details = &ircproto.Reply_EndOfList{EndOfList: end}
+
+	default:
+		if isErrorNumeric(reply.GetNumeric()) {
+			// <client> [<subject>] :<reason>
+			if n < 2 {
+				return
+			}
+			e := &ircproto.ErrorReply{Reason: params[n-1]}
+			if n > 2 {
+				e.Subject = params[1]
+			}
+			reply.Details = &ircproto.Reply_Error{Error: e}
+		}
+	}
+}
+
+// Returns the part of a WHOIS reply in params, or nil if there are too few
+// parameters.
+func whoisReply(numeric string, params []string) *ircproto.WhoisReply {
+	n := len(params)
+	// <client> <nick> ...
+	if n < 2 {
+		return nil
+	}
+	whois := &ircproto.WhoisReply{Nick: params[1]}
+	switch numeric {
+	case irc.RPL_WHOISUSER:
+		// <client> <nick> <user> <host> * :<realname>
+		if n < 6 {
+			return nil
+		}
+		whois.User = params[2]
+		whois.Host = params[3]
+		whois.Realname = params[5]
+
+	case irc.RPL_WHOISSERVER:
+		// <client> <nick> <server> :<info>
+		if n < 3 {
+			return nil
+		}
+		whois.Server = params[2]
+		if n > 3 {
+			whois.ServerInfo = params[3]
+		}
+
+	case irc.RPL_WHOISOPERATOR:
+		whois.Operator = true
+
+	case irc.RPL_WHOISIDLE:
+		// <client> <nick> <secs> [<signon>] :seconds idle
+		if n < 4 {
+			return nil
+		}
+		whois.IdleSeconds = parseInt64(params[2])
+		if n > 4 {
+			whois.Signon = parseInt64(params[3])
+		}
+
+	case irc.RPL_WHOISCHANNELS:
+		// <client> <nick> :<channels>
+		if n < 3 {
+			return nil
+		}
+		whois.Channels = strings.Fields(params[2])
+
+	case RPL_WHOISACCOUNT:
+		// <client> <nick> <account> :is logged in as
+		if n < 3 {
+			return nil
+		}
+		whois.Account = params[2]
+	}
+	return whois
+}
+
+// Returns the topic reply in params, or nil if there are too few parameters.
+func topicReply(numeric string, params []string) *ircproto.TopicReply {
+	n := len(params)
+	// <client> <channel> ...
+	if n < 2 {
+		return nil
+	}
+	topic := &ircproto.TopicReply{Channel: params[1]}
+	switch numeric {
+	case irc.RPL_TOPIC:
+		// <client> <channel> :<topic>
+		if n < 3 {
+			return nil
+		}
+		topic.Topic = params[2]
+
+	case RPL_TOPICWHOTIME:
+		// <client> <channel> <nick> <setat>
+		if n < 4 {
+			return nil
+		}
+		topic.SetBy = params[2]
+		topic.SetAt = parseInt64(params[3])
+	}
+	return topic
+}
+
+// Parses ISUPPORT tokens such as "CHANTYPES=#&", "EXCEPTS" and "-KNOCK".
+func parseISupport(tokens []string) *ircproto.ISupport {
+	isupport := &ircproto.ISupport{Params: make(map[string]string)}
+	for _, token := range tokens {
+		if strings.HasPrefix(token, "-") {
+			isupport.Removed = append(isupport.Removed, token[1:])
+			continue
+		}
+		name, value := token, ""
+		if i := strings.IndexByte(token, '='); i >= 0 {
+			name, value = token[:i], unescapeISupportValue(token[i+1:])
+		}
+		isupport.Params[name] = value
+	}
+	return isupport
+}
+
+// Decodes "\xHH" escapes, which servers use for spaces, "=" and "\".
+func unescapeISupportValue(s string) string {
+	if !strings.Contains(s, "\\x") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Returns whether numeric is an error reply (400-599).
+func isErrorNumeric(numeric string) bool {
+	n, err := strconv.Atoi(numeric)
+	return err == nil && n >= 400 && n < 600
+}
+
+// Parses a number, or returns 0 if it isn't one.
+func parseInt64(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
@@ -0,0 +1,170 @@
+package ircconnection
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type RepliesTest struct{}
+
+var _ = Suite(&RepliesTest{})
+
+func (s *RepliesTest) TestWelcome(c *C) {
+	p := incoming(c, ":irc.test 001 iq :Welcome to the network, iq")
+	c.Check(p.GetReply().GetNumeric(), Equals, "001")
+	c.Check(p.GetReply().GetParams(), DeepEquals, []string{"iq"})
+	c.Check(p.GetReply().GetWelcome().GetNick(), Equals, "iq")
+	c.Check(p.GetReply().GetWelcome().GetMessage(), Equals,
+		"Welcome to the network, iq")
+}
+
+func (s *RepliesTest) TestISupport(c *C) {
+	p := incoming(c, ":irc.test 005 iq CHANTYPES=#& EXCEPTS -KNOCK "+
+		"NETWORK=Test\\x20Net :are supported by this server")
+	isupport := p.GetReply().GetIsupport()
+	c.Assert(isupport, NotNil)
+	c.Check(isupport.GetParams(), DeepEquals, map[string]string{
+		"CHANTYPES": "#&",
+		"EXCEPTS":   "",
+		"NETWORK":   "Test Net",
+	})
+	c.Check(isupport.GetRemoved(), DeepEquals, []string{"KNOCK"})
+}
+
+func (s *RepliesTest) TestISupportWithoutText(c *C) {
+	p := incoming(c, ":irc.test 005 iq CHANTYPES=# PREFIX=(ov)@+")
+	c.Check(p.GetReply().GetIsupport().GetParams(), DeepEquals, map[string]string{
+		"CHANTYPES": "#",
+		"PREFIX":    "(ov)@+",
+	})
+
+	// The last token may be sent as trailing instead.
+	p = incoming(c, ":irc.test 005 iq CHANTYPES=# :PREFIX=(ov)@+")
+	c.Check(p.GetReply().GetIsupport().GetParams(), DeepEquals, map[string]string{
+		"CHANTYPES": "#",
+		"PREFIX":    "(ov)@+",
+	})
+}
+
+func (s *RepliesTest) TestMotd(c *C) {
+	p := incoming(c, ":irc.test 372 iq :- Be nice")
+	c.Check(p.GetReply().GetMotd().GetLine(), Equals, "Be nice")
+
+	p = incoming(c, ":irc.test 376 iq :End of /MOTD command.")
+	c.Check(p.GetReply().GetMotd(), NotNil)
+	c.Check(p.GetReply().GetMotd().GetLine(), Equals, "")
+}
+
+func (s *RepliesTest) TestNames(c *C) {
+	p := incoming(c, ":irc.test 353 iq = #iq :@alice +bob carol")
+	names := p.GetReply().GetNames()
+	c.Check(names.GetVisibility(), Equals, "=")
+	c.Check(names.GetChannel(), Equals, "#iq")
+	c.Check(names.GetNames(), DeepEquals, []string{"@alice", "+bob", "carol"})
+
+	// Without the symbol.
+	p = incoming(c, ":irc.test 353 iq #iq :alice")
+	c.Check(p.GetReply().GetNames().GetVisibility(), Equals, "")
+	c.Check(p.GetReply().GetNames().GetChannel(), Equals, "#iq")
+
+	p = incoming(c, ":irc.test 366 iq #iq :End of /NAMES list.")
+	c.Check(p.GetReply().GetEndOfList().GetTarget(), Equals, "#iq")
+	c.Check(p.GetReply().GetEndOfList().GetMessage(), Equals,
+		"End of /NAMES list.")
+}
+
+func (s *RepliesTest) TestWho(c *C) {
+	p := incoming(c,
+		":irc.test 352 iq #iq ~a host.test irc.test alice H@ :0 Alice Liddell")
+	who := p.GetReply().GetWho()
+	c.Check(who.GetChannel(), Equals, "#iq")
+	c.Check(who.GetUser(), Equals, "~a")
+	c.Check(who.GetHost(), Equals, "host.test")
+	c.Check(who.GetServer(), Equals, "irc.test")
+	c.Check(who.GetNick(), Equals, "alice")
+	c.Check(who.GetFlags(), Equals, "H@")
+	c.Check(who.GetHops(), Equals, int32(0))
+	c.Check(who.GetRealname(), Equals, "Alice Liddell")
+
+	p = incoming(c, ":irc.test 352 iq #iq ~a host.test")
+	c.Check(p.GetReply().GetDetails(), IsNil)
+}
+
+func (s *RepliesTest) TestWhois(c *C) {
+	p := incoming(c, ":irc.test 311 iq alice ~a host.test * :Alice Liddell")
+	whois := p.GetReply().GetWhois()
+	c.Check(whois.GetNick(), Equals, "alice")
+	c.Check(whois.GetUser(), Equals, "~a")
+	c.Check(whois.GetHost(), Equals, "host.test")
+	c.Check(whois.GetRealname(), Equals, "Alice Liddell")
+
+	p = incoming(c, ":irc.test 312 iq alice irc.test :Test server")
+	c.Check(p.GetReply().GetWhois().GetServer(), Equals, "irc.test")
+	c.Check(p.GetReply().GetWhois().GetServerInfo(), Equals, "Test server")
+
+	p = incoming(c, ":irc.test 313 iq alice :is an IRC operator")
+	c.Check(p.GetReply().GetWhois().GetOperator(), Equals, true)
+
+	p = incoming(c, ":irc.test 317 iq alice 42 1400000000 :seconds idle")
+	c.Check(p.GetReply().GetWhois().GetIdleSeconds(), Equals, int64(42))
+	c.Check(p.GetReply().GetWhois().GetSignon(), Equals, int64(1400000000))
+
+	p = incoming(c, ":irc.test 319 iq alice :@#iq +#go")
+	c.Check(p.GetReply().GetWhois().GetChannels(), DeepEquals,
+		[]string{"@#iq", "+#go"})
+
+	p = incoming(c, ":irc.test 330 iq alice alicea :is logged in as")
+	c.Check(p.GetReply().GetWhois().GetAccount(), Equals, "alicea")
+
+	p = incoming(c, ":irc.test 318 iq alice :End of /WHOIS list.")
+	c.Check(p.GetReply().GetEndOfList().GetTarget(), Equals, "alice")
+}
+
+func (s *RepliesTest) TestTopic(c *C) {
+	p := incoming(c, ":irc.test 332 iq #iq :Welcome to #iq")
+	c.Check(p.GetReply().GetTopic().GetChannel(), Equals, "#iq")
+	c.Check(p.GetReply().GetTopic().GetTopic(), Equals, "Welcome to #iq")
+
+	p = incoming(c, ":irc.test 333 iq #iq alice 1400000000")
+	c.Check(p.GetReply().GetTopic().GetSetBy(), Equals, "alice")
+	c.Check(p.GetReply().GetTopic().GetSetAt(), Equals, int64(1400000000))
+
+	p = incoming(c, ":irc.test 331 iq #iq :No topic is set")
+	c.Check(p.GetReply().GetTopic().GetChannel(), Equals, "#iq")
+	c.Check(p.GetReply().GetTopic().GetTopic(), Equals, "")
+}
+
+func (s *RepliesTest) TestBanList(c *C) {
+	p := incoming(c, ":irc.test 367 iq #iq *!*@spam.test alice 1400000000")
+	entry := p.GetReply().GetListEntry()
+	c.Check(entry.GetChannel(), Equals, "#iq")
+	c.Check(entry.GetMask(), Equals, "*!*@spam.test")
+	c.Check(entry.GetSetBy(), Equals, "alice")
+	c.Check(entry.GetSetAt(), Equals, int64(1400000000))
+
+	// Without who set it.
+	p = incoming(c, ":irc.test 348 iq #iq *!*@friend.test")
+	c.Check(p.GetReply().GetListEntry().GetMask(), Equals, "*!*@friend.test")
+	c.Check(p.GetReply().GetListEntry().GetSetBy(), Equals, "")
+
+	p = incoming(c, ":irc.test 368 iq #iq :End of channel ban list")
+	c.Check(p.GetReply().GetEndOfList().GetTarget(), Equals, "#iq")
+}
+
+func (s *RepliesTest) TestErrors(c *C) {
+	p := incoming(c, ":irc.test 433 * iq :Nickname is already in use")
+	c.Check(p.GetReply().GetError().GetSubject(), Equals, "iq")
+	c.Check(p.GetReply().GetError().GetReason(), Equals,
+		"Nickname is already in use")
+
+	p = incoming(c, ":irc.test 451 * :You have not registered")
+	c.Check(p.GetReply().GetError().GetSubject(), Equals, "")
+	c.Check(p.GetReply().GetError().GetReason(), Equals,
+		"You have not registered")
+}
+
+func (s *RepliesTest) TestOtherReplies(c *C) {
+	p := incoming(c, ":irc.test 002 iq :Your host is irc.test")
+	c.Check(p.GetReply().GetNumeric(), Equals, "002")
+	c.Check(p.GetReply().GetTrailing(), Equals, "Your host is irc.test")
+	c.Check(p.GetReply().GetDetails(), IsNil)
+}
@@ -0,0 +1,116 @@
+package ircconnection
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format of the IRCv3 server-time tag.
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// Replacements for characters that can't appear in tag values.
+var (
+	tagEscaper = strings.NewReplacer(
+		"\\", "\\\\", ";", "\\:", " ", "\\s", "\r", "\\r", "\n", "\\n")
+	tagUnescapes = map[byte]byte{
+		':': ';', 's': ' ', '\\': '\\', 'r': '\r', 'n': '\n'}
+)
+
+// Splits the IRCv3 message tags off the front of line. Returns nil tags if
+// there are none.
+func splitTags(line string) (map[string]string, string) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line
+	}
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return parseTags(line[1:]), ""
+	}
+	return parseTags(line[1:i]), strings.TrimLeft(line[i+1:], " ")
+}
+
+// Parses "key=value;key2" into a map. Missing values are empty.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			key, value = tag[:i], unescapeTagValue(tag[i+1:])
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+func unescapeTagValue(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			// A trailing backslash is dropped.
+			break
+		}
+		if c, ok := tagUnescapes[s[i]]; ok {
+			b.WriteByte(c)
+		} else {
+			// Unknown escapes stand for the character itself.
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// Formats tags for the front of a line, without the "@" or trailing space.
+// Keys are sorted so the output is stable.
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key
+		if value := tags[key]; value != "" {
+			parts[i] += "=" + tagEscaper.Replace(value)
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// Checks that tag keys can be sent. Values are escaped as needed.
+func checkTags(tags map[string]string) error {
+	for key := range tags {
+		if key == "" || strings.ContainsAny(key, "=; \r\n\x00") {
+			return errors.New("Invalid tag key: \"" + key + "\"")
+		}
+	}
+	return nil
+}
+
+// Returns the time a message was sent according to its server-time tag, or
+// received if it has none.
+func messageTime(tags map[string]string, received time.Time) time.Time {
+	if value, ok := tags["time"]; ok {
+		if t, err := time.Parse(serverTimeFormat, value); err == nil {
+			return t
+		}
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t
+		}
+	}
+	return received
+}
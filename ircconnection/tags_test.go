@@ -0,0 +1,118 @@
+package ircconnection
+
+import (
+	"bufio"
+	ircproto "github.com/msparks/iq/public/irc"
+	. "gopkg.in/check.v1"
+	"io"
+	"time"
+)
+
+type TagsTest struct{}
+
+var _ = Suite(&TagsTest{})
+
+func (s *TagsTest) TestSplitTags(c *C) {
+	tags, rest := splitTags(
+		"@time=2011-10-19T16:40:51.620Z;msgid=abc;+draft/typing  :a PRIVMSG #iq :hi")
+	c.Check(tags, DeepEquals, map[string]string{
+		"time":          "2011-10-19T16:40:51.620Z",
+		"msgid":         "abc",
+		"+draft/typing": "",
+	})
+	c.Check(rest, Equals, ":a PRIVMSG #iq :hi")
+
+	tags, rest = splitTags(":a PRIVMSG #iq :@hi")
+	c.Check(tags, IsNil)
+	c.Check(rest, Equals, ":a PRIVMSG #iq :@hi")
+}
+
+func (s *TagsTest) TestEscaping(c *C) {
+	tags := parseTags(`a=one\stwo\:three\\four\r\n;b=\x\;c=end\`)
+	c.Check(tags, DeepEquals, map[string]string{
+		"a": "one two;three\\four\r\n",
+		"b": "x",
+		"c": "end",
+	})
+
+	c.Check(formatTags(map[string]string{
+		"label": "a b;c\\",
+		"+flag": "",
+	}), Equals, `+flag;label=a\sb\:c\\`)
+
+	// Values survive a round trip.
+	in := map[string]string{"k": "; \\\r\n=x"}
+	c.Check(parseTags(formatTags(in)), DeepEquals, in)
+}
+
+func (s *TagsTest) TestMessageTime(c *C) {
+	received := time.Unix(1000, 0)
+	tags := map[string]string{"time": "2011-10-19T16:40:51.620Z"}
+	c.Check(messageTime(tags, received).Equal(
+		time.Date(2011, 10, 19, 16, 40, 51, 620e6, time.UTC)), Equals, true)
+
+	c.Check(messageTime(nil, received), Equals, received)
+	tags["time"] = "yesterday"
+	c.Check(messageTime(tags, received), Equals, received)
+}
+
+func (s *TagsTest) TestCheckTags(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+			Target:  "#iq",
+			Message: "hi",
+		}},
+		Tags: map[string]string{"bad key": "x"},
+	}
+	c.Check(outgoingError(msg), ErrorMatches, "Invalid tag key: .*")
+}
+
+func (s *TagsTest) TestReadAndWrite(c *C) {
+	server := localServer(c)
+	defer server.Close()
+
+	ic := NewIRCConnection([]Endpoint{{Address: server.Addr().String()}})
+	c.Assert(ic.StateIs(CONNECTING), IsNil)
+	notifiee := ic.NewNotifiee()
+
+	peer, err := server.Accept()
+	c.Assert(err, IsNil)
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+	<-notifiee  // CONNECTED
+
+	// Incoming tags are parsed and server-time is used for the time.
+	io.WriteString(peer,
+		"@time=2011-10-19T16:40:51.620Z;account=alice :alice!a@host PRIVMSG #iq :hi\r\n")
+	io.WriteString(peer, ":bob!b@host PRIVMSG #iq :hello\r\n")
+	var got []IncomingMessageNotification
+	for len(got) < 2 {
+		if v, ok := (<-notifiee).(IncomingMessageNotification); ok {
+			got = append(got, v)
+		}
+	}
+	c.Check(got[0].Message.GetPrivmsg().GetMessage(), Equals, "hi")
+	c.Check(got[0].Message.GetTags(), DeepEquals, map[string]string{
+		"time":    "2011-10-19T16:40:51.620Z",
+		"account": "alice",
+	})
+	c.Check(got[0].Time.Equal(
+		time.Date(2011, 10, 19, 16, 40, 51, 620e6, time.UTC)), Equals, true)
+	c.Check(got[1].Message.GetTags(), IsNil)
+	c.Check(time.Since(got[1].Time) < time.Minute, Equals, true)
+
+	// Outgoing tags are escaped.
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+			Target:  "#iq",
+			Message: "hi",
+		}},
+		Tags: map[string]string{"label": "a b"},
+	}
+	c.Assert(ic.OutgoingMessageIs(msg), IsNil)
+	line, err := bufio.NewReader(peer).ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Check(line, Equals, "@label=a\\sb PRIVMSG #iq :hi\r\n")
+
+	shutDown(c, ic, notifiee)
+}
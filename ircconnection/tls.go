@@ -0,0 +1,133 @@
+package ircconnection
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Returns the TLS configuration for an endpoint.
+func (ep Endpoint) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         ep.ServerName,
+		InsecureSkipVerify: ep.InsecureSkipVerify,
+	}
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(ep.Address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+
+	if ep.CAFile != "" {
+		pem, err := ioutil.ReadFile(ep.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", ep.CAFile)
+		}
+	}
+
+	if ep.CertFile != "" {
+		keyFile := ep.KeyFile
+		if keyFile == "" {
+			keyFile = ep.CertFile
+		}
+		cert, err := tls.LoadX509KeyPair(ep.CertFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	// A pinned certificate is trusted regardless of who signed it, so the
+	// chain is not verified. The fingerprint is checked after the handshake.
+	if ep.Fingerprint != "" {
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// Dials an endpoint, negotiating TLS if the endpoint requires it. The TLS
+// configuration used is returned, or nil for plain connections.
+func dial(dialer *net.Dialer, ep Endpoint) (net.Conn, *tls.Config, error) {
+	if !ep.TLS {
+		conn, err := dialer.Dial("tcp", ep.Address)
+		return conn, nil, err
+	}
+
+	config, err := ep.tlsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", ep.Address, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ep.Fingerprint != "" {
+		if err := verifyFingerprint(conn, ep.Fingerprint); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, config, nil
+}
+
+// Checks the server certificate of an established connection against a
+// pinned SHA-256 fingerprint.
+func verifyFingerprint(conn *tls.Conn, fingerprint string) error {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("Server presented no certificate")
+	}
+	got := certFingerprint(certs[0])
+	if got != normalizeFingerprint(fingerprint) {
+		return fmt.Errorf("Certificate fingerprint mismatch: got %s", got)
+	}
+	return nil
+}
+
+// Returns the fingerprints of the server certificate and of the client
+// certificate offered to it. Both are empty if the connection does not use TLS.
+func fingerprints(conn net.Conn, config *tls.Config) (server, client string) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", ""
+	}
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		server = certFingerprint(certs[0])
+	}
+	if len(config.Certificates) > 0 && len(config.Certificates[0].Certificate) > 0 {
+		client = derFingerprint(config.Certificates[0].Certificate[0])
+	}
+	return server, client
+}
+
+// Returns the hex-encoded SHA-256 fingerprint of a certificate.
+func certFingerprint(cert *x509.Certificate) string {
+	return derFingerprint(cert.Raw)
+}
+
+// Returns the hex-encoded SHA-256 fingerprint of a DER-encoded certificate.
+func derFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Lowercases a hex fingerprint and removes separating colons, so that the
+// common "AB:CD:..." format matches.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
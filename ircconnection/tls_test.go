@@ -0,0 +1,294 @@
+package ircconnection
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type TLSTest struct {
+	// Self-signed server certificate for iq.test.
+	cert tls.Certificate
+
+	// PEM file containing the certificate.
+	caFile string
+}
+
+var _ = Suite(&TLSTest{})
+
+// Generates a self-signed certificate and returns it with its PEM encoding.
+func selfSignedCert(c *C, name string) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageKeyEncipherment |
+			x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	c.Assert(err, IsNil)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	c.Assert(err, IsNil)
+	return cert, certPEM
+}
+
+func (s *TLSTest) SetUpSuite(c *C) {
+	var certPEM []byte
+	s.cert, certPEM = selfSignedCert(c, "iq.test")
+	s.caFile = filepath.Join(c.MkDir(), "ca.pem")
+	c.Assert(ioutil.WriteFile(s.caFile, certPEM, 0600), IsNil)
+}
+
+// Returns a listening local TLS server for testing.
+func (s *TLSTest) tlsServer(c *C) net.Listener {
+	server, err := tls.Listen("tcp", "[::1]:0", &tls.Config{
+		Certificates: []tls.Certificate{s.cert},
+	})
+	c.Assert(err, IsNil)
+	return server
+}
+
+// Connects to ep, which is served by server, and waits for the outcome.
+// Returns the connection, the server side of it and the certificate
+// notification, if one was delivered.
+func (s *TLSTest) connect(c *C, server net.Listener, ep Endpoint) (
+	*IRCConnection, *tls.Conn, *PeerCertificateNotification) {
+	ic := NewIRCConnection([]Endpoint{ep})
+	notifiee := ic.NewNotifiee()
+	defer ic.CloseNotifiee(notifiee)
+	go ic.StateIs(CONNECTING)
+	<-notifiee  // CONNECTING
+
+	// The TLS handshake happens on the first read or write.
+	conn, err := server.Accept()
+	c.Assert(err, IsNil)
+	peer := conn.(*tls.Conn)
+	go peer.Handshake()
+
+	// Wait for CONNECTED or DISCONNECTED.
+	var cert *PeerCertificateNotification
+	for {
+		switch v := (<-notifiee).(type) {
+		case PeerCertificateNotification:
+			cert = &v
+		case StateChangeNotification:
+			return ic, peer, cert
+		}
+	}
+}
+
+func (s *TLSTest) TestCAFile(c *C) {
+	server := s.tlsServer(c)
+	defer server.Close()
+
+	ep := Endpoint{
+		Address:    server.Addr().String(),
+		TLS:        true,
+		ServerName: "iq.test",
+		CAFile:     s.caFile,
+	}
+	ic, peer, _ := s.connect(c, server, ep)
+	defer peer.Close()
+	c.Check(ic.Err, IsNil)
+	c.Check(ic.State(), Equals, CONNECTED)
+}
+
+func (s *TLSTest) TestWrongServerName(c *C) {
+	server := s.tlsServer(c)
+	defer server.Close()
+
+	ep := Endpoint{
+		Address:    server.Addr().String(),
+		TLS:        true,
+		ServerName: "other.test",
+		CAFile:     s.caFile,
+	}
+	ic, peer, _ := s.connect(c, server, ep)
+	defer peer.Close()
+	c.Check(ic.State(), Equals, DISCONNECTED)
+	c.Check(ic.Err, NotNil)
+}
+
+func (s *TLSTest) TestUnknownAuthority(c *C) {
+	server := s.tlsServer(c)
+	defer server.Close()
+
+	ep := Endpoint{
+		Address:    server.Addr().String(),
+		TLS:        true,
+		ServerName: "iq.test",
+	}
+	ic, peer, _ := s.connect(c, server, ep)
+	defer peer.Close()
+	c.Check(ic.State(), Equals, DISCONNECTED)
+	c.Check(ic.Err, ErrorMatches, ".*certificate.*")
+}
+
+func (s *TLSTest) TestInsecureSkipVerify(c *C) {
+	server := s.tlsServer(c)
+	defer server.Close()
+
+	ep := Endpoint{
+		Address:            server.Addr().String(),
+		TLS:                true,
+		InsecureSkipVerify: true,
+	}
+	ic, peer, _ := s.connect(c, server, ep)
+	defer peer.Close()
+	c.Check(ic.Err, IsNil)
+	c.Check(ic.State(), Equals, CONNECTED)
+}
+
+func (s *TLSTest) TestFingerprint(c *C) {
+	server := s.tlsServer(c)
+	defer server.Close()
+
+	leaf, err := x509.ParseCertificate(s.cert.Certificate[0])
+	c.Assert(err, IsNil)
+
+	// Colon-separated uppercase fingerprints are accepted.
+	var parts []string
+	fp := strings.ToUpper(certFingerprint(leaf))
+	for i := 0; i < len(fp); i += 2 {
+		parts = append(parts, fp[i:i+2])
+	}
+
+	ep := Endpoint{
+		Address:     server.Addr().String(),
+		TLS:         true,
+		Fingerprint: strings.Join(parts, ":"),
+	}
+	ic, peer, cert := s.connect(c, server, ep)
+	defer peer.Close()
+	c.Check(ic.Err, IsNil)
+	c.Check(ic.State(), Equals, CONNECTED)
+	c.Assert(cert, NotNil)
+	c.Check(cert.Fingerprint, Equals, certFingerprint(leaf))
+	c.Check(cert.ClientFingerprint, Equals, "")
+	c.Check(ic.PeerFingerprint(), Equals, certFingerprint(leaf))
+}
+
+func (s *TLSTest) TestFingerprintMismatch(c *C) {
+	server := s.tlsServer(c)
+	defer server.Close()
+
+	ep := Endpoint{
+		Address:     server.Addr().String(),
+		TLS:         true,
+		Fingerprint: strings.Repeat("00", 32),
+	}
+	ic, peer, _ := s.connect(c, server, ep)
+	defer peer.Close()
+	c.Check(ic.State(), Equals, DISCONNECTED)
+	c.Check(ic.Err, ErrorMatches, "Certificate fingerprint mismatch.*")
+}
+
+func (s *TLSTest) TestBadCAFile(c *C) {
+	ep := Endpoint{
+		Address: "[::1]:6697",
+		TLS:     true,
+		CAFile:  filepath.Join(c.MkDir(), "missing.pem"),
+	}
+	_, err := ep.tlsConfig()
+	c.Check(err, NotNil)
+}
+
+func (s *TLSTest) TestPlainConnectionHasNoFingerprint(c *C) {
+	server := localServer(c)
+	defer server.Close()
+
+	ic := NewIRCConnection([]Endpoint{{Address: server.Addr().String()}})
+	notifiee := ic.NewNotifiee()
+	go ic.StateIs(CONNECTING)
+	<-notifiee  // CONNECTING
+	peer, _ := server.Accept()
+	defer peer.Close()
+	defer ic.CloseNotifiee(notifiee)
+	_, ok := (<-notifiee).(StateChangeNotification)  // CONNECTED
+	c.Check(ok, Equals, true)
+	c.Check(ic.PeerFingerprint(), Equals, "")
+}
+
+func (s *TLSTest) TestClientCertificate(c *C) {
+	// Write a client certificate and key to disk.
+	clientCert, certPEM := selfSignedCert(c, "iq-client")
+	keyDER, err := x509.MarshalECPrivateKey(
+		clientCert.PrivateKey.(*ecdsa.PrivateKey))
+	c.Assert(err, IsNil)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	dir := c.MkDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	c.Assert(ioutil.WriteFile(certFile, certPEM, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, keyPEM, 0600), IsNil)
+
+	server, err := tls.Listen("tcp", "[::1]:0", &tls.Config{
+		Certificates: []tls.Certificate{s.cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	ep := Endpoint{
+		Address:    server.Addr().String(),
+		TLS:        true,
+		ServerName: "iq.test",
+		CAFile:     s.caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+	}
+	ic, peer, cert := s.connect(c, server, ep)
+	defer peer.Close()
+	c.Assert(ic.Err, IsNil)
+	c.Check(ic.State(), Equals, CONNECTED)
+
+	// The server saw our certificate, and its fingerprint was reported.
+	peerCerts := peer.ConnectionState().PeerCertificates
+	c.Assert(len(peerCerts), Equals, 1)
+	c.Assert(cert, NotNil)
+	c.Check(cert.ClientFingerprint, Equals, certFingerprint(peerCerts[0]))
+	c.Check(cert.Endpoint, Equals, ep)
+}
+
+func (s *TLSTest) TestCombinedCertAndKeyFile(c *C) {
+	clientCert, certPEM := selfSignedCert(c, "iq-client")
+	keyDER, err := x509.MarshalECPrivateKey(
+		clientCert.PrivateKey.(*ecdsa.PrivateKey))
+	c.Assert(err, IsNil)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile := filepath.Join(c.MkDir(), "client.pem")
+	c.Assert(ioutil.WriteFile(certFile, append(certPEM, keyPEM...), 0600), IsNil)
+
+	ep := Endpoint{Address: "[::1]:6697", TLS: true, CertFile: certFile}
+	config, err := ep.tlsConfig()
+	c.Assert(err, IsNil)
+	c.Check(len(config.Certificates), Equals, 1)
+}
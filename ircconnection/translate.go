@@ -1,47 +1,331 @@
 package ircconnection
 
-import "code.google.com/p/goprotobuf/proto"
 import "errors"
 import ircproto "github.com/msparks/iq/public/irc"
 import "github.com/sorcix/irc"
 import "strconv"
+import "strings"
+
+// IRCv3 commands.
+const (
+	capCommand          = "CAP"
+	authenticateCommand = "AUTHENTICATE"
+	monitorCommand      = "MONITOR"
+	accountCommand      = "ACCOUNT"
+	chghostCommand      = "CHGHOST"
+)
+
+// Delimits a CTCP message in the body of a PRIVMSG or NOTICE.
+const ctcpDelim = "\x01"
 
 func protoAsMessage(p *ircproto.Message) (message *irc.Message, err error) {
 	message = &irc.Message{}
 
-	switch p.GetType() {
-	case ircproto.Message_PONG:
+	switch p.GetPayload().(type) {
+	case *ircproto.Message_Ping:
+		if p.GetPing().GetTarget() == "" {
+			return nil, errors.New("target must be specified")
+		}
+		message.Command = irc.PING
+		message.Trailing = p.GetPing().GetTarget()
+
+	case *ircproto.Message_Pong:
 		message.Command = irc.PONG
-		message.Params = []string{p.GetPong().GetSource()}
+		if source := p.GetPong().GetSource(); source != "" {
+			message.Params = []string{source}
+		}
 		message.Trailing = p.GetPong().GetTarget()
 
-	case ircproto.Message_NICK:
-		message.Command = irc.NICK
-		message.Params = []string{p.GetNick().GetNewNick()}
-		if len(message.Params) == 0 {
+	case *ircproto.Message_Privmsg:
+		target := p.GetPrivmsg().GetTarget()
+		if target == "" {
+			return nil, errors.New("target must be specified")
+		}
+		text := p.GetPrivmsg().GetMessage()
+		if text == "" {
+			return nil, errors.New("message must be specified")
+		}
+		message.Command = irc.PRIVMSG
+		message.Params = []string{target}
+		message.Trailing = text
+
+	case *ircproto.Message_Notice:
+		target := p.GetNotice().GetTarget()
+		if target == "" {
+			return nil, errors.New("target must be specified")
+		}
+		text := p.GetNotice().GetMessage()
+		if text == "" {
+			return nil, errors.New("message must be specified")
+		}
+		message.Command = irc.NOTICE
+		message.Params = []string{target}
+		message.Trailing = text
+
+	case *ircproto.Message_Ctcp:
+		ctcp := p.GetCtcp()
+		if ctcp.GetTarget() == "" {
+			return nil, errors.New("target must be specified")
+		}
+		command := ctcp.GetCommand()
+		if command == "" {
+			return nil, errors.New("command must be specified")
+		}
+		if strings.ContainsAny(command, " "+ctcpDelim) ||
+			strings.Contains(ctcp.GetParams(), ctcpDelim) {
+			return nil, errors.New("invalid character in CTCP message")
+		}
+		message.Command = irc.PRIVMSG
+		if ctcp.GetReply() {
+			message.Command = irc.NOTICE
+		}
+		message.Params = []string{ctcp.GetTarget()}
+		text := strings.ToUpper(command)
+		if ctcp.GetParams() != "" {
+			text += " " + ctcp.GetParams()
+		}
+		message.Trailing = ctcpDelim + text + ctcpDelim
+
+	case *ircproto.Message_Nick:
+		nick := p.GetNick().GetNewNick()
+		if nick == "" {
 			return nil, errors.New("new_nick must be specified")
 		}
+		message.Command = irc.NICK
+		message.Params = []string{nick}
 
-	case ircproto.Message_USER:
+	case *ircproto.Message_User:
 		user := p.GetUser().GetUser()
 		if user == "" {
 			return nil, errors.New("user must be specified")
 		}
 		message.Command = irc.USER
 		// TODO(msparks): Mode.
-		message.Params = []string{user, "0", "*", p.GetUser().GetRealname()}
+		message.Params = []string{user, "0", "*"}
+		// The realname may contain spaces, and must be sent even if empty.
+		message.Trailing = p.GetUser().GetRealname()
+		message.EmptyTrailing = message.Trailing == ""
+
+	case *ircproto.Message_Cap:
+		subcommand := p.GetCap().GetSubcommand()
+		if subcommand == "" {
+			return nil, errors.New("subcommand must be specified")
+		}
+		message.Command = capCommand
+		message.Params = []string{subcommand}
+		if version := p.GetCap().GetVersion(); version != "" {
+			message.Params = append(message.Params, version)
+		}
+		if caps := p.GetCap().GetCapabilities(); len(caps) > 0 {
+			message.Trailing = strings.Join(caps, " ")
+		}
+
+	case *ircproto.Message_Authenticate:
+		data := p.GetAuthenticate().GetData()
+		if data == "" {
+			return nil, errors.New("data must be specified")
+		}
+		message.Command = authenticateCommand
+		message.Params = []string{data}
+
+	case *ircproto.Message_Join:
+		channels := p.GetJoin().GetChannels()
+		if len(channels) == 0 {
+			return nil, errors.New("channels must be specified")
+		}
+		keys := p.GetJoin().GetKeys()
+		if len(keys) > len(channels) {
+			return nil, errors.New("more keys than channels")
+		}
+		message.Command = irc.JOIN
+		message.Params = []string{strings.Join(channels, ",")}
+		if len(keys) > 0 {
+			message.Params = append(message.Params, strings.Join(keys, ","))
+		}
+
+	case *ircproto.Message_Monitor:
+		subcommand := p.GetMonitor().GetSubcommand()
+		if subcommand == "" {
+			return nil, errors.New("subcommand must be specified")
+		}
+		message.Command = monitorCommand
+		message.Params = []string{subcommand}
+		if targets := p.GetMonitor().GetTargets(); len(targets) > 0 {
+			message.Params = append(message.Params, strings.Join(targets, ","))
+		}
+
+	case *ircproto.Message_Ison:
+		nicks := p.GetIson().GetNicks()
+		if len(nicks) == 0 {
+			return nil, errors.New("nicks must be specified")
+		}
+		message.Command = irc.ISON
+		message.Params = nicks
+
+	case *ircproto.Message_Part:
+		channels := p.GetPart().GetChannels()
+		if len(channels) == 0 {
+			return nil, errors.New("channels must be specified")
+		}
+		message.Command = irc.PART
+		message.Params = []string{strings.Join(channels, ",")}
+		message.Trailing = p.GetPart().GetMessage()
+
+	case *ircproto.Message_Quit:
+		message.Command = irc.QUIT
+		message.Trailing = p.GetQuit().GetMessage()
+
+	case *ircproto.Message_Topic:
+		channel := p.GetTopic().GetChannel()
+		if channel == "" {
+			return nil, errors.New("channel must be specified")
+		}
+		message.Command = irc.TOPIC
+		message.Params = []string{channel}
+		if p.GetTopic().Topic != nil {
+			// An empty topic clears it.
+			message.Trailing = p.GetTopic().GetTopic()
+			message.EmptyTrailing = message.Trailing == ""
+		}
+
+	case *ircproto.Message_Mode:
+		target := p.GetMode().GetTarget()
+		if target == "" {
+			return nil, errors.New("target must be specified")
+		}
+		modes := p.GetMode().GetModes()
+		args := p.GetMode().GetArgs()
+		if modes == "" && len(args) > 0 {
+			return nil, errors.New("args given without modes")
+		}
+		message.Command = irc.MODE
+		message.Params = []string{target}
+		if modes != "" {
+			message.Params = append(message.Params, modes)
+			message.Params = append(message.Params, args...)
+		}
+
+	case *ircproto.Message_Kick:
+		channel := p.GetKick().GetChannel()
+		if channel == "" {
+			return nil, errors.New("channel must be specified")
+		}
+		nick := p.GetKick().GetNick()
+		if nick == "" {
+			return nil, errors.New("nick must be specified")
+		}
+		message.Command = irc.KICK
+		message.Params = []string{channel, nick}
+		message.Trailing = p.GetKick().GetMessage()
+
+	case *ircproto.Message_Invite:
+		nick := p.GetInvite().GetNick()
+		if nick == "" {
+			return nil, errors.New("nick must be specified")
+		}
+		channel := p.GetInvite().GetChannel()
+		if channel == "" {
+			return nil, errors.New("channel must be specified")
+		}
+		message.Command = irc.INVITE
+		message.Params = []string{nick, channel}
+
+	case *ircproto.Message_Away:
+		message.Command = irc.AWAY
+		message.Trailing = p.GetAway().GetMessage()
+
+	case *ircproto.Message_Who:
+		mask := p.GetWho().GetMask()
+		if mask == "" {
+			return nil, errors.New("mask must be specified")
+		}
+		message.Command = irc.WHO
+		message.Params = []string{mask}
+		if flags := p.GetWho().GetFlags(); flags != "" {
+			message.Params = append(message.Params, flags)
+		}
+
+	case *ircproto.Message_Whois:
+		nicks := p.GetWhois().GetNicks()
+		if len(nicks) == 0 {
+			return nil, errors.New("nicks must be specified")
+		}
+		message.Command = irc.WHOIS
+		if server := p.GetWhois().GetServer(); server != "" {
+			message.Params = []string{server}
+		}
+		message.Params = append(message.Params, strings.Join(nicks, ","))
+
+	case *ircproto.Message_List:
+		message.Command = irc.LIST
+		if channels := p.GetList().GetChannels(); len(channels) > 0 {
+			message.Params = []string{strings.Join(channels, ",")}
+		}
+
+	case *ircproto.Message_Names:
+		message.Command = irc.NAMES
+		if channels := p.GetNames().GetChannels(); len(channels) > 0 {
+			message.Params = []string{strings.Join(channels, ",")}
+		}
+
+	case *ircproto.Message_Raw:
+		raw := p.GetRaw()
+		if raw.Line != nil {
+			if strings.ContainsAny(raw.GetLine(), "\r\n\x00") {
+				return nil, errors.New("invalid character in line")
+			}
+			message = irc.ParseMessage(raw.GetLine())
+			if message == nil {
+				return nil, errors.New("line could not be parsed")
+			}
+			break
+		}
+		if raw.GetCommand() == "" {
+			return nil, errors.New("command or line must be specified")
+		}
+		message.Command = raw.GetCommand()
+		message.Params = raw.GetParams()
+		if raw.Trailing != nil {
+			message.Trailing = raw.GetTrailing()
+			message.EmptyTrailing = message.Trailing == ""
+		}
 
 	default:
 		return nil, errors.New("Unknown message type")
 	}
 
+	if err := checkMessage(message); err != nil {
+		return nil, err
+	}
+	if err := checkTags(p.GetTags()); err != nil {
+		return nil, err
+	}
 	return message, nil
 }
 
-func messageAsProto(message *irc.Message) (p *ircproto.Message, err error) {
-	p = &ircproto.Message{
-		Type: ircproto.Message_UNKNOWN.Enum(),
+// Checks that message encodes to the line it describes. Line breaks would
+// let a caller smuggle in extra commands, and spaces or a leading colon
+// would shift the parameters around.
+func checkMessage(message *irc.Message) error {
+	for _, param := range message.Params {
+		if strings.ContainsAny(param, "\r\n\x00") {
+			return errors.New("invalid character in parameter")
+		}
+		if param == "" || strings.HasPrefix(param, ":") {
+			return errors.New("invalid parameter: \"" + param + "\"")
+		}
+		if strings.Contains(param, " ") {
+			return errors.New("invalid parameter: \"" + param + "\"")
+		}
 	}
+	if strings.ContainsAny(message.Trailing, "\r\n\x00") {
+		return errors.New("invalid character in trailing parameter")
+	}
+	return nil
+}
+
+func messageAsProto(message *irc.Message) (p *ircproto.Message, err error) {
+	p = &ircproto.Message{}
 
 	switch message.Command {
 	case irc.PING:
@@ -49,69 +333,301 @@ func messageAsProto(message *irc.Message) (p *ircproto.Message, err error) {
 		if len(message.Params) > 0 {
 			source = message.Params[0]
 		}
-		p.Type = ircproto.Message_PING.Enum()
-		p.Ping = &ircproto.Ping{
-			Source: proto.String(source),
-			Target: proto.String(message.Trailing),
+		p.Payload = &ircproto.Message_Ping{Ping: &ircproto.Ping{
+			Source: source,
+			Target: message.Trailing,
+		}}
+
+	case irc.PONG:
+		var source string
+		if len(message.Params) > 0 {
+			source = message.Params[0]
 		}
+		p.Payload = &ircproto.Message_Pong{Pong: &ircproto.Pong{
+			Source: source,
+			Target: pongToken(message),
+		}}
 
 	case irc.PRIVMSG:
 		var target string
 		if len(message.Params) > 0 {
 			target = message.Params[0]
 		}
-		p.Type = ircproto.Message_PRIVMSG.Enum()
-		p.Privmsg = &ircproto.Privmsg{
-			Source:  prefixProto(message.Prefix),
-			Target:  proto.String(target),
-			Message: proto.String(message.Trailing),
+		if ctcp := ctcpProto(message, target); ctcp != nil {
+			p.Payload = &ircproto.Message_Ctcp{Ctcp: ctcp}
+			break
 		}
+		p.Payload = &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+			Source:  prefixProto(message.Prefix),
+			Target:  target,
+			Message: message.Trailing,
+		}}
 
 	case irc.NOTICE:
 		var target string
 		if len(message.Params) > 0 {
 			target = message.Params[0]
 		}
-		p.Type = ircproto.Message_NOTICE.Enum()
-		p.Notice = &ircproto.Notice{
-			Source:  prefixProto(message.Prefix),
-			Target:  proto.String(target),
-			Message: proto.String(message.Trailing),
+		if ctcp := ctcpProto(message, target); ctcp != nil {
+			ctcp.Reply = true
+			p.Payload = &ircproto.Message_Ctcp{Ctcp: ctcp}
+			break
 		}
+		p.Payload = &ircproto.Message_Notice{Notice: &ircproto.Notice{
+			Source:  prefixProto(message.Prefix),
+			Target:  target,
+			Message: message.Trailing,
+		}}
 
 	case irc.NICK:
-		if len(message.Params) == 0 {
-			return nil, errors.New("Params must be non-empty")
+		params := allParams(message)
+		if len(params) == 0 {
+			return nil, errors.New("NICK requires a nick")
+		}
+		p.Payload = &ircproto.Message_Nick{Nick: &ircproto.Nick{
+			Source:  prefixProto(message.Prefix),
+			NewNick: params[0],
+		}}
+
+	case capCommand:
+		// CAP <target> <subcommand> [*] :<capabilities>
+		if len(message.Params) < 2 {
+			return nil, errors.New("CAP requires a target and subcommand")
+		}
+		c := &ircproto.Cap{
+			Source:     prefixProto(message.Prefix),
+			Target:     message.Params[0],
+			Subcommand: strings.ToUpper(message.Params[1]),
+		}
+		rest := message.Params[2:]
+		if len(rest) > 0 && rest[0] == "*" {
+			c.More = true
+			rest = rest[1:]
+		}
+		if message.Trailing != "" {
+			c.Capabilities = strings.Fields(message.Trailing)
+		} else {
+			// Some servers omit the colon for a single capability.
+			c.Capabilities = rest
+		}
+		p.Payload = &ircproto.Message_Cap{Cap: c}
+
+	case authenticateCommand:
+		data := message.Trailing
+		if len(message.Params) > 0 {
+			data = message.Params[0]
+		}
+		p.Payload = &ircproto.Message_Authenticate{Authenticate: &ircproto.Authenticate{
+			Source: prefixProto(message.Prefix),
+			Data:   data,
+		}}
+
+	case irc.JOIN:
+		// JOIN <channels> [<account> :<realname>]
+		params := allParams(message)
+		if len(params) == 0 {
+			return nil, errors.New("JOIN requires a channel")
+		}
+		join := &ircproto.Join{
+			Source:   prefixProto(message.Prefix),
+			Channels: strings.Split(params[0], ","),
+		}
+		if len(params) >= 3 {
+			join.Account = params[1]
+			join.Realname = params[2]
+		}
+		p.Payload = &ircproto.Message_Join{Join: join}
+
+	case irc.PART:
+		params := allParams(message)
+		if len(params) == 0 {
+			return nil, errors.New("PART requires a channel")
+		}
+		part := &ircproto.Part{
+			Source:   prefixProto(message.Prefix),
+			Channels: strings.Split(params[0], ","),
+		}
+		if len(params) > 1 {
+			part.Message = params[1]
+		}
+		p.Payload = &ircproto.Message_Part{Part: part}
+
+	case irc.QUIT:
+		p.Payload = &ircproto.Message_Quit{Quit: &ircproto.Quit{
+			Source:  prefixProto(message.Prefix),
+			Message: lastParam(message),
+		}}
+
+	case irc.KICK:
+		params := allParams(message)
+		if len(params) < 2 {
+			return nil, errors.New("KICK requires a channel and nick")
+		}
+		kick := &ircproto.Kick{
+			Source:  prefixProto(message.Prefix),
+			Channel: params[0],
+			Nick:    params[1],
+		}
+		if len(params) > 2 {
+			kick.Message = params[2]
 		}
-		p.Type = ircproto.Message_NICK.Enum()
-		p.Nick = &ircproto.Nick{
+		p.Payload = &ircproto.Message_Kick{Kick: kick}
+
+	case irc.MODE:
+		// MODE <target> <modes> [<args>...]
+		params := allParams(message)
+		if len(params) < 2 {
+			return nil, errors.New("MODE requires a target and modes")
+		}
+		p.Payload = &ircproto.Message_Mode{Mode: &ircproto.Mode{
 			Source: prefixProto(message.Prefix),
-			NewNick: proto.String(message.Params[0]),
+			Target: params[0],
+			Modes:  params[1],
+			Args:   params[2:],
+		}}
+
+	case irc.TOPIC:
+		params := allParams(message)
+		if len(params) < 2 {
+			return nil, errors.New("TOPIC requires a channel and topic")
+		}
+		topic := params[1]
+		p.Payload = &ircproto.Message_Topic{Topic: &ircproto.Topic{
+			Source:  prefixProto(message.Prefix),
+			Channel: params[0],
+			Topic:   &topic,
+		}}
+
+	case irc.INVITE:
+		params := allParams(message)
+		if len(params) < 2 {
+			return nil, errors.New("INVITE requires a nick and channel")
+		}
+		p.Payload = &ircproto.Message_Invite{Invite: &ircproto.Invite{
+			Source:  prefixProto(message.Prefix),
+			Nick:    params[0],
+			Channel: params[1],
+		}}
+
+	case irc.ERROR:
+		p.Payload = &ircproto.Message_Error{Error: &ircproto.Error{
+			Message: lastParam(message),
+		}}
+
+	case accountCommand:
+		params := allParams(message)
+		if len(params) == 0 {
+			return nil, errors.New("ACCOUNT requires an account")
 		}
+		p.Payload = &ircproto.Message_Account{Account: &ircproto.Account{
+			Source:  prefixProto(message.Prefix),
+			Account: params[0],
+		}}
+
+	case irc.AWAY:
+		// No message means the user is back.
+		p.Payload = &ircproto.Message_Away{Away: &ircproto.Away{
+			Source:  prefixProto(message.Prefix),
+			Message: lastParam(message),
+		}}
+
+	case chghostCommand:
+		params := allParams(message)
+		if len(params) < 2 {
+			return nil, errors.New("CHGHOST requires a user and host")
+		}
+		p.Payload = &ircproto.Message_Chghost{Chghost: &ircproto.Chghost{
+			Source:  prefixProto(message.Prefix),
+			NewUser: params[0],
+			NewHost: params[1],
+		}}
 
 	default:
 		// Maybe the command is a numeric reply?
 		if _, err := strconv.ParseInt(message.Command, 10, 32); err == nil {
-			p.Type = ircproto.Message_REPLY.Enum()
-			p.Reply = &ircproto.Reply{
+			reply := &ircproto.Reply{
 				Source:   prefixProto(message.Prefix),
-				Numeric:  proto.String(message.Command),
+				Numeric:  message.Command,
 				Params:   message.Params,
-				Trailing: proto.String(message.Trailing),
+				Trailing: message.Trailing,
 			}
+			setReplyDetails(reply, allParams(message))
+			p.Payload = &ircproto.Message_Reply{Reply: reply}
 		} else {
-			return nil, errors.New("Unknown command")
+			p = rawProto(message)
 		}
 	}
 
 	return p, nil
 }
 
+// Returns message as a RAW message, without the original line.
+func rawProto(message *irc.Message) *ircproto.Message {
+	raw := &ircproto.Raw{
+		Source:  prefixProto(message.Prefix),
+		Command: message.Command,
+		Params:  message.Params,
+	}
+	if message.Trailing != "" || message.EmptyTrailing {
+		trailing := message.Trailing
+		raw.Trailing = &trailing
+	}
+	return &ircproto.Message{
+		Payload: &ircproto.Message_Raw{Raw: raw},
+	}
+}
+
+// Returns the CTCP message in the body of a PRIVMSG or NOTICE, or nil if
+// the body is not one. Some clients leave off the closing delimiter.
+func ctcpProto(message *irc.Message, target string) *ircproto.Ctcp {
+	text := message.Trailing
+	if !strings.HasPrefix(text, ctcpDelim) {
+		return nil
+	}
+	text = strings.TrimSuffix(text[1:], ctcpDelim)
+	command, params := text, ""
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		command, params = text[:i], text[i+1:]
+	}
+	if command == "" {
+		return nil
+	}
+	return &ircproto.Ctcp{
+		Source:  prefixProto(message.Prefix),
+		Target:  target,
+		Command: strings.ToUpper(command),
+		Params:  params,
+	}
+}
+
+// Returns the parameters of message, including the trailing one if present.
+// Servers differ in which parameters they send as trailing.
+func allParams(message *irc.Message) []string {
+	if message.Trailing == "" && !message.EmptyTrailing {
+		return message.Params
+	}
+	params := make([]string, len(message.Params), len(message.Params)+1)
+	copy(params, message.Params)
+	return append(params, message.Trailing)
+}
+
+// Returns the last parameter of message, or empty if there are none.
+func lastParam(message *irc.Message) string {
+	params := allParams(message)
+	if len(params) == 0 {
+		return ""
+	}
+	return params[len(params)-1]
+}
+
 func prefixProto(prefix *irc.Prefix) (p *ircproto.Prefix) {
+	if prefix == nil {
+		return nil
+	}
 	p = &ircproto.Prefix{
-		Name: proto.String(prefix.Name),
-		User: proto.String(prefix.User),
-		Host: proto.String(prefix.Host),
+		Name: prefix.Name,
+		User: prefix.User,
+		Host: prefix.Host,
 	}
 	return p
 }
@@ -0,0 +1,672 @@
+package ircconnection
+
+import (
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"google.golang.org/protobuf/proto"
+	. "gopkg.in/check.v1"
+)
+
+type TranslateTest struct{}
+
+var _ = Suite(&TranslateTest{})
+
+// Translates an outgoing message and returns it in wire format.
+func outgoingLine(c *C, p *ircproto.Message) string {
+	msg, err := protoAsMessage(p)
+	c.Assert(err, IsNil)
+	return msg.String()
+}
+
+// Translates an outgoing message and checks that its wire format parses back
+// to the same message.
+func roundTrip(c *C, p *ircproto.Message) string {
+	line := outgoingLine(c, p)
+	c.Check(irc.ParseMessage(line).String(), Equals, line)
+	return line
+}
+
+// Returns the error from translating an outgoing message.
+func outgoingError(p *ircproto.Message) error {
+	_, err := protoAsMessage(p)
+	return err
+}
+
+// Parses and translates an incoming line.
+func incoming(c *C, line string) *ircproto.Message {
+	p, err := messageAsProto(irc.ParseMessage(line))
+	c.Assert(err, IsNil)
+	return p
+}
+
+func (s *TranslateTest) TestOutgoingUser(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_User{User: &ircproto.User{
+			User:     "iq",
+			Realname: "Foo Bar",
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "USER iq 0 * :Foo Bar")
+
+	msg.GetUser().Realname = ""
+	c.Check(roundTrip(c, msg), Equals, "USER iq 0 * :")
+
+	msg.GetUser().Realname = "Foo\r\nQUIT"
+	c.Check(outgoingError(msg), ErrorMatches, "invalid character in trailing parameter")
+
+	msg.GetUser().User = ""
+	c.Check(outgoingError(msg), ErrorMatches, "user must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingCap(c *C) {
+	ls := &ircproto.Message{
+		Payload: &ircproto.Message_Cap{Cap: &ircproto.Cap{
+			Subcommand: "LS",
+			Version:    "302",
+		}},
+	}
+	c.Check(outgoingLine(c, ls), Equals, "CAP LS 302")
+
+	req := &ircproto.Message{
+		Payload: &ircproto.Message_Cap{Cap: &ircproto.Cap{
+			Subcommand:   "REQ",
+			Capabilities: []string{"server-time", "sasl"},
+		}},
+	}
+	c.Check(outgoingLine(c, req), Equals, "CAP REQ :server-time sasl")
+
+	_, err := protoAsMessage(&ircproto.Message{
+		Payload: &ircproto.Message_Cap{Cap: &ircproto.Cap{}},
+	})
+	c.Check(err, ErrorMatches, "subcommand must be specified")
+}
+
+func (s *TranslateTest) TestIncomingCap(c *C) {
+	p := incoming(c, ":irc.test CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL")
+	c.Assert(p.GetCap(), NotNil)
+	c.Check(p.GetCap().GetSource().GetName(), Equals, "irc.test")
+	c.Check(p.GetCap().GetTarget(), Equals, "*")
+	c.Check(p.GetCap().GetSubcommand(), Equals, "LS")
+	c.Check(p.GetCap().GetMore(), Equals, true)
+	c.Check(p.GetCap().GetCapabilities(), DeepEquals,
+		[]string{"multi-prefix", "sasl=PLAIN,EXTERNAL"})
+
+	p = incoming(c, ":irc.test CAP nick ack :server-time")
+	c.Check(p.GetCap().GetSubcommand(), Equals, "ACK")
+	c.Check(p.GetCap().GetMore(), Equals, false)
+	c.Check(p.GetCap().GetCapabilities(), DeepEquals, []string{"server-time"})
+
+	// Single capability without a colon.
+	p = incoming(c, ":irc.test CAP nick NEW away-notify")
+	c.Check(p.GetCap().GetCapabilities(), DeepEquals, []string{"away-notify"})
+
+	_, err := messageAsProto(irc.ParseMessage(":irc.test CAP nick"))
+	c.Check(err, NotNil)
+}
+
+func (s *TranslateTest) TestAuthenticate(c *C) {
+	out := &ircproto.Message{
+		Payload: &ircproto.Message_Authenticate{Authenticate: &ircproto.Authenticate{
+			Data: "PLAIN",
+		}},
+	}
+	c.Check(outgoingLine(c, out), Equals, "AUTHENTICATE PLAIN")
+
+	_, err := protoAsMessage(&ircproto.Message{
+		Payload: &ircproto.Message_Authenticate{Authenticate: &ircproto.Authenticate{}},
+	})
+	c.Check(err, ErrorMatches, "data must be specified")
+
+	p := incoming(c, "AUTHENTICATE +")
+	c.Assert(p.GetAuthenticate(), NotNil)
+	c.Check(p.GetAuthenticate().GetData(), Equals, "+")
+
+	p = incoming(c, ":irc.test AUTHENTICATE :+")
+	c.Check(p.GetAuthenticate().GetData(), Equals, "+")
+}
+
+func (s *TranslateTest) TestOutgoingPrivmsg(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+			Target:  "NickServ",
+			Message: "REGAIN iq",
+		}},
+	}
+	c.Check(outgoingLine(c, msg), Equals, "PRIVMSG NickServ :REGAIN iq")
+
+	_, err := protoAsMessage(&ircproto.Message{
+		Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{Message: "hi"}},
+	})
+	c.Check(err, ErrorMatches, "target must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingMonitor(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Monitor{Monitor: &ircproto.Monitor{
+			Subcommand: "+",
+			Targets:    []string{"iq", "iq_"},
+		}},
+	}
+	c.Check(outgoingLine(c, msg), Equals, "MONITOR + iq,iq_")
+
+	msg.Payload = &ircproto.Message_Monitor{Monitor: &ircproto.Monitor{Subcommand: "C"}}
+	c.Check(outgoingLine(c, msg), Equals, "MONITOR C")
+}
+
+func (s *TranslateTest) TestOutgoingIson(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Ison{Ison: &ircproto.Ison{Nicks: []string{"iq", "iq_"}}},
+	}
+	c.Check(outgoingLine(c, msg), Equals, "ISON iq iq_")
+
+	msg.Payload = &ircproto.Message_Ison{Ison: &ircproto.Ison{}}
+	_, err := protoAsMessage(msg)
+	c.Check(err, ErrorMatches, "nicks must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingJoin(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Join{Join: &ircproto.Join{
+			Channels: []string{"#secret", "#iq", "#go"},
+			Keys:     []string{"hunter2"},
+		}},
+	}
+	c.Check(outgoingLine(c, msg), Equals, "JOIN #secret,#iq,#go hunter2")
+
+	msg.Payload = &ircproto.Message_Join{Join: &ircproto.Join{Channels: []string{"#iq"}}}
+	c.Check(outgoingLine(c, msg), Equals, "JOIN #iq")
+
+	msg.Payload = &ircproto.Message_Join{Join: &ircproto.Join{}}
+	_, err := protoAsMessage(msg)
+	c.Check(err, ErrorMatches, "channels must be specified")
+
+	msg.Payload = &ircproto.Message_Join{Join: &ircproto.Join{
+		Channels: []string{"#iq"},
+		Keys:     []string{"a", "b"},
+	}}
+	_, err = protoAsMessage(msg)
+	c.Check(err, ErrorMatches, "more keys than channels")
+}
+
+func (s *TranslateTest) TestPingPong(c *C) {
+	ping := &ircproto.Message{
+		Payload: &ircproto.Message_Ping{Ping: &ircproto.Ping{Target: "iq-1"}},
+	}
+	c.Check(outgoingLine(c, ping), Equals, "PING :iq-1")
+
+	_, err := protoAsMessage(&ircproto.Message{Payload: &ircproto.Message_Ping{Ping: &ircproto.Ping{}}})
+	c.Check(err, ErrorMatches, "target must be specified")
+
+	p := incoming(c, ":irc.test PONG irc.test :iq-1")
+	c.Check(p.GetPong(), NotNil)
+	c.Check(p.GetPong().GetSource(), Equals, "irc.test")
+	c.Check(p.GetPong().GetTarget(), Equals, "iq-1")
+
+	// Some servers don't use a trailing parameter.
+	p = incoming(c, ":irc.test PONG irc.test iq-2")
+	c.Check(p.GetPong().GetTarget(), Equals, "iq-2")
+}
+
+func (s *TranslateTest) TestOutgoingNotice(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Notice{Notice: &ircproto.Notice{
+			Target:  "#iq",
+			Message: "hello there",
+		}},
+	}
+	line := roundTrip(c, msg)
+	c.Check(line, Equals, "NOTICE #iq :hello there")
+	c.Check(incoming(c, line).GetNotice().GetMessage(), Equals, "hello there")
+
+	msg.Payload = &ircproto.Message_Notice{Notice: &ircproto.Notice{Target: "#iq"}}
+	c.Check(outgoingError(msg), ErrorMatches, "message must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingPart(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Part{Part: &ircproto.Part{
+			Channels: []string{"#iq", "#go"},
+			Message:  "bye now",
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "PART #iq,#go :bye now")
+
+	msg.Payload = &ircproto.Message_Part{Part: &ircproto.Part{Channels: []string{"#iq"}}}
+	c.Check(roundTrip(c, msg), Equals, "PART #iq")
+
+	msg.Payload = &ircproto.Message_Part{Part: &ircproto.Part{}}
+	c.Check(outgoingError(msg), ErrorMatches, "channels must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingQuit(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Quit{Quit: &ircproto.Quit{Message: "Leaving"}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "QUIT :Leaving")
+
+	msg.Payload = &ircproto.Message_Quit{}
+	c.Check(roundTrip(c, msg), Equals, "QUIT")
+}
+
+func (s *TranslateTest) TestOutgoingTopic(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Topic{Topic: &ircproto.Topic{
+			Channel: "#iq",
+			Topic:   proto.String("Welcome to #iq"),
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "TOPIC #iq :Welcome to #iq")
+
+	// Clearing the topic is different from asking for it.
+	msg.GetTopic().Topic = proto.String("")
+	c.Check(roundTrip(c, msg), Equals, "TOPIC #iq :")
+	msg.GetTopic().Topic = nil
+	c.Check(roundTrip(c, msg), Equals, "TOPIC #iq")
+
+	msg.Payload = &ircproto.Message_Topic{Topic: &ircproto.Topic{}}
+	c.Check(outgoingError(msg), ErrorMatches, "channel must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingMode(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Mode{Mode: &ircproto.Mode{
+			Target: "#iq",
+			Modes:  "+ob",
+			Args:   []string{"alice", "*!*@spam"},
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "MODE #iq +ob alice *!*@spam")
+
+	msg.Payload = &ircproto.Message_Mode{Mode: &ircproto.Mode{Target: "#iq"}}
+	c.Check(roundTrip(c, msg), Equals, "MODE #iq")
+
+	msg.Payload = &ircproto.Message_Mode{Mode: &ircproto.Mode{
+		Target: "#iq",
+		Args:   []string{"alice"},
+	}}
+	c.Check(outgoingError(msg), ErrorMatches, "args given without modes")
+
+	msg.Payload = &ircproto.Message_Mode{Mode: &ircproto.Mode{Modes: "+i"}}
+	c.Check(outgoingError(msg), ErrorMatches, "target must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingKick(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Kick{Kick: &ircproto.Kick{
+			Channel: "#iq",
+			Nick:    "spammer",
+			Message: "no spam",
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "KICK #iq spammer :no spam")
+
+	msg.GetKick().Message = ""
+	c.Check(roundTrip(c, msg), Equals, "KICK #iq spammer")
+
+	msg.Payload = &ircproto.Message_Kick{Kick: &ircproto.Kick{Channel: "#iq"}}
+	c.Check(outgoingError(msg), ErrorMatches, "nick must be specified")
+	msg.Payload = &ircproto.Message_Kick{Kick: &ircproto.Kick{Nick: "spammer"}}
+	c.Check(outgoingError(msg), ErrorMatches, "channel must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingInvite(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Invite{Invite: &ircproto.Invite{
+			Nick:    "alice",
+			Channel: "#iq",
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "INVITE alice #iq")
+
+	msg.Payload = &ircproto.Message_Invite{Invite: &ircproto.Invite{Nick: "alice"}}
+	c.Check(outgoingError(msg), ErrorMatches, "channel must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingAway(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Away{Away: &ircproto.Away{Message: "Gone fishing"}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "AWAY :Gone fishing")
+
+	msg.Payload = &ircproto.Message_Away{Away: &ircproto.Away{}}
+	c.Check(roundTrip(c, msg), Equals, "AWAY")
+}
+
+func (s *TranslateTest) TestOutgoingWho(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Who{Who: &ircproto.Who{
+			Mask:  "#iq",
+			Flags: "%cuhnfa",
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "WHO #iq %cuhnfa")
+
+	msg.Payload = &ircproto.Message_Who{Who: &ircproto.Who{}}
+	c.Check(outgoingError(msg), ErrorMatches, "mask must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingWhois(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Whois{Whois: &ircproto.Whois{
+			Server: "alice",
+			Nicks:  []string{"alice"},
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "WHOIS alice alice")
+
+	msg.Payload = &ircproto.Message_Whois{Whois: &ircproto.Whois{Nicks: []string{"alice", "bob"}}}
+	c.Check(roundTrip(c, msg), Equals, "WHOIS alice,bob")
+
+	msg.Payload = &ircproto.Message_Whois{Whois: &ircproto.Whois{}}
+	c.Check(outgoingError(msg), ErrorMatches, "nicks must be specified")
+}
+
+func (s *TranslateTest) TestOutgoingListAndNames(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_List{List: &ircproto.List{Channels: []string{"#iq", "#go"}}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "LIST #iq,#go")
+	msg.Payload = &ircproto.Message_List{}
+	c.Check(roundTrip(c, msg), Equals, "LIST")
+
+	msg = &ircproto.Message{
+		Payload: &ircproto.Message_Names{Names: &ircproto.Names{Channels: []string{"#iq"}}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "NAMES #iq")
+	msg.Payload = &ircproto.Message_Names{}
+	c.Check(roundTrip(c, msg), Equals, "NAMES")
+}
+
+func (s *TranslateTest) TestOutgoingRoundTrips(c *C) {
+	// Commands that we also parse come back unchanged.
+	for _, msg := range []*ircproto.Message{
+		{
+			Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+				Target:  "#iq",
+				Message: "hi there",
+			}},
+		},
+		{
+			Payload: &ircproto.Message_Ping{Ping: &ircproto.Ping{
+				Source: "",
+				Target: "token",
+			}},
+		},
+		{
+			Payload: &ircproto.Message_Authenticate{Authenticate: &ircproto.Authenticate{Data: "PLAIN"}},
+		},
+	} {
+		c.Check(incoming(c, roundTrip(c, msg)), DeepEquals, msg)
+	}
+
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Cap{Cap: &ircproto.Cap{
+			Subcommand:   "REQ",
+			Capabilities: []string{"sasl", "server-time"},
+		}},
+	}
+	p := incoming(c, "CAP * "+roundTrip(c, msg)[len("CAP "):])
+	c.Check(p.GetCap().GetSubcommand(), Equals, "REQ")
+	c.Check(p.GetCap().GetCapabilities(), DeepEquals, msg.GetCap().GetCapabilities())
+}
+
+func (s *TranslateTest) TestOutgoingValidation(c *C) {
+	// Line breaks could smuggle in another command.
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+			Target:  "#iq",
+			Message: "hi\r\nQUIT",
+		}},
+	}
+	c.Check(outgoingError(msg), ErrorMatches,
+		"invalid character in trailing parameter")
+
+	// Spaces and colons would shift the parameters.
+	msg.Payload = &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+		Target:  "#iq :oops",
+		Message: "hi",
+	}}
+	c.Check(outgoingError(msg), ErrorMatches, "invalid parameter: .*")
+
+	msg = &ircproto.Message{
+		Payload: &ircproto.Message_Join{Join: &ircproto.Join{Channels: []string{":#iq"}}},
+	}
+	c.Check(outgoingError(msg), ErrorMatches, "invalid parameter: .*")
+
+	msg = &ircproto.Message{
+		Payload: &ircproto.Message_Nick{Nick: &ircproto.Nick{}},
+	}
+	c.Check(outgoingError(msg), ErrorMatches, "new_nick must be specified")
+
+	c.Check(outgoingError(&ircproto.Message{}), ErrorMatches,
+		"Unknown message type")
+}
+
+func (s *TranslateTest) TestIncomingJoin(c *C) {
+	p := incoming(c, ":alice!a@host JOIN #iq")
+	c.Check(p.GetJoin(), NotNil)
+	c.Check(p.GetJoin().GetSource().GetName(), Equals, "alice")
+	c.Check(p.GetJoin().GetChannels(), DeepEquals, []string{"#iq"})
+	c.Check(p.GetJoin().GetAccount(), Equals, "")
+
+	p = incoming(c, ":alice!a@host JOIN :#iq")
+	c.Check(p.GetJoin().GetChannels(), DeepEquals, []string{"#iq"})
+
+	// extended-join
+	p = incoming(c, ":alice!a@host JOIN #iq alice :Alice Liddell")
+	c.Check(p.GetJoin().GetAccount(), Equals, "alice")
+	c.Check(p.GetJoin().GetRealname(), Equals, "Alice Liddell")
+
+	_, err := messageAsProto(irc.ParseMessage(":alice!a@host JOIN"))
+	c.Check(err, ErrorMatches, "JOIN requires a channel")
+}
+
+func (s *TranslateTest) TestIncomingPart(c *C) {
+	p := incoming(c, ":alice!a@host PART #iq :Goodbye all")
+	c.Check(p.GetPart(), NotNil)
+	c.Check(p.GetPart().GetChannels(), DeepEquals, []string{"#iq"})
+	c.Check(p.GetPart().GetMessage(), Equals, "Goodbye all")
+
+	p = incoming(c, ":alice!a@host PART #iq,#go")
+	c.Check(p.GetPart().GetChannels(), DeepEquals, []string{"#iq", "#go"})
+	c.Check(p.GetPart().GetMessage(), Equals, "")
+}
+
+func (s *TranslateTest) TestIncomingQuit(c *C) {
+	p := incoming(c, ":alice!a@host QUIT :Quit: leaving")
+	c.Check(p.GetQuit(), NotNil)
+	c.Check(p.GetQuit().GetSource().GetHost(), Equals, "host")
+	c.Check(p.GetQuit().GetMessage(), Equals, "Quit: leaving")
+}
+
+func (s *TranslateTest) TestIncomingNick(c *C) {
+	p := incoming(c, ":alice!a@host NICK alice_")
+	c.Check(p.GetNick(), NotNil)
+	c.Check(p.GetNick().GetSource().GetName(), Equals, "alice")
+	c.Check(p.GetNick().GetNewNick(), Equals, "alice_")
+
+	p = incoming(c, ":alice!a@host NICK :alice_")
+	c.Check(p.GetNick().GetNewNick(), Equals, "alice_")
+
+	_, err := messageAsProto(irc.ParseMessage(":alice!a@host NICK"))
+	c.Check(err, ErrorMatches, "NICK requires a nick")
+}
+
+func (s *TranslateTest) TestIncomingKick(c *C) {
+	p := incoming(c, ":op!o@host KICK #iq spammer :no spam")
+	c.Check(p.GetKick(), NotNil)
+	c.Check(p.GetKick().GetSource().GetName(), Equals, "op")
+	c.Check(p.GetKick().GetChannel(), Equals, "#iq")
+	c.Check(p.GetKick().GetNick(), Equals, "spammer")
+	c.Check(p.GetKick().GetMessage(), Equals, "no spam")
+
+	_, err := messageAsProto(irc.ParseMessage(":op!o@host KICK #iq"))
+	c.Check(err, ErrorMatches, "KICK requires a channel and nick")
+}
+
+func (s *TranslateTest) TestIncomingMode(c *C) {
+	p := incoming(c, ":op!o@host MODE #iq +ob alice *!*@spam")
+	c.Check(p.GetMode(), NotNil)
+	c.Check(p.GetMode().GetTarget(), Equals, "#iq")
+	c.Check(p.GetMode().GetModes(), Equals, "+ob")
+	c.Check(p.GetMode().GetArgs(), DeepEquals, []string{"alice", "*!*@spam"})
+
+	// User modes usually come as a trailing parameter.
+	p = incoming(c, ":iq MODE iq :+iw")
+	c.Check(p.GetMode().GetTarget(), Equals, "iq")
+	c.Check(p.GetMode().GetModes(), Equals, "+iw")
+	c.Check(p.GetMode().GetArgs(), HasLen, 0)
+}
+
+func (s *TranslateTest) TestIncomingTopic(c *C) {
+	p := incoming(c, ":op!o@host TOPIC #iq :Welcome to #iq")
+	c.Check(p.GetTopic(), NotNil)
+	c.Check(p.GetTopic().GetChannel(), Equals, "#iq")
+	c.Check(p.GetTopic().GetTopic(), Equals, "Welcome to #iq")
+
+	// Cleared.
+	p = incoming(c, ":op!o@host TOPIC #iq :")
+	c.Check(p.GetTopic().Topic, NotNil)
+	c.Check(p.GetTopic().GetTopic(), Equals, "")
+}
+
+func (s *TranslateTest) TestIncomingInvite(c *C) {
+	p := incoming(c, ":alice!a@host INVITE iq :#iq")
+	c.Check(p.GetInvite(), NotNil)
+	c.Check(p.GetInvite().GetSource().GetName(), Equals, "alice")
+	c.Check(p.GetInvite().GetNick(), Equals, "iq")
+	c.Check(p.GetInvite().GetChannel(), Equals, "#iq")
+}
+
+func (s *TranslateTest) TestIncomingError(c *C) {
+	p := incoming(c, "ERROR :Closing Link: host (Ping timeout)")
+	c.Check(p.GetError(), NotNil)
+	c.Check(p.GetError().GetMessage(), Equals, "Closing Link: host (Ping timeout)")
+}
+
+func (s *TranslateTest) TestIncomingAccount(c *C) {
+	p := incoming(c, ":alice!a@host ACCOUNT alice")
+	c.Check(p.GetAccount(), NotNil)
+	c.Check(p.GetAccount().GetSource().GetName(), Equals, "alice")
+	c.Check(p.GetAccount().GetAccount(), Equals, "alice")
+
+	p = incoming(c, ":alice!a@host ACCOUNT *")
+	c.Check(p.GetAccount().GetAccount(), Equals, "*")
+}
+
+func (s *TranslateTest) TestIncomingAway(c *C) {
+	p := incoming(c, ":alice!a@host AWAY :Gone fishing")
+	c.Check(p.GetAway(), NotNil)
+	c.Check(p.GetAway().GetMessage(), Equals, "Gone fishing")
+
+	p = incoming(c, ":alice!a@host AWAY")
+	c.Check(p.GetAway().GetMessage(), Equals, "")
+}
+
+func (s *TranslateTest) TestIncomingChghost(c *C) {
+	p := incoming(c, ":alice!a@host CHGHOST alice2 new.host")
+	c.Check(p.GetChghost(), NotNil)
+	c.Check(p.GetChghost().GetSource().GetUser(), Equals, "a")
+	c.Check(p.GetChghost().GetNewUser(), Equals, "alice2")
+	c.Check(p.GetChghost().GetNewHost(), Equals, "new.host")
+}
+
+func (s *TranslateTest) TestIncomingRaw(c *C) {
+	p := incoming(c, ":irc.test WALLOPS :Server restarting")
+	c.Check(p.GetRaw(), NotNil)
+	c.Check(p.GetRaw().GetSource().GetName(), Equals, "irc.test")
+	c.Check(p.GetRaw().GetCommand(), Equals, "WALLOPS")
+	c.Check(p.GetRaw().GetParams(), HasLen, 0)
+	c.Check(p.GetRaw().GetTrailing(), Equals, "Server restarting")
+
+	p = incoming(c, "SETNAME a b")
+	c.Check(p.GetRaw().GetParams(), DeepEquals, []string{"a", "b"})
+	c.Check(p.GetRaw().Trailing, IsNil)
+}
+
+func (s *TranslateTest) TestOutgoingRaw(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Raw{Raw: &ircproto.Raw{
+			Command:  "KNOCK",
+			Params:   []string{"#iq"},
+			Trailing: proto.String("let me in"),
+		}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "KNOCK #iq :let me in")
+
+	msg.GetRaw().Trailing = proto.String("")
+	c.Check(roundTrip(c, msg), Equals, "KNOCK #iq :")
+
+	// Incoming RAW messages can be sent back out.
+	msg = incoming(c, "CHATHISTORY LATEST #iq * 50")
+	c.Check(roundTrip(c, msg), Equals, "CHATHISTORY LATEST #iq * 50")
+
+	msg = &ircproto.Message{
+		Payload: &ircproto.Message_Raw{Raw: &ircproto.Raw{Line: proto.String("OPER iq :hunter2 hunter3")}},
+	}
+	c.Check(roundTrip(c, msg), Equals, "OPER iq :hunter2 hunter3")
+
+	msg.Payload = &ircproto.Message_Raw{Raw: &ircproto.Raw{Line: proto.String("PRIVMSG #iq :hi\r\nQUIT")}}
+	c.Check(outgoingError(msg), ErrorMatches, "invalid character in line")
+
+	msg.Payload = &ircproto.Message_Raw{Raw: &ircproto.Raw{Params: []string{"#iq"}}}
+	c.Check(outgoingError(msg), ErrorMatches,
+		"command or line must be specified")
+
+	msg.Payload = &ircproto.Message_Raw{Raw: &ircproto.Raw{
+		Command: "KNOCK",
+		Params:  []string{"#iq two"},
+	}}
+	c.Check(outgoingError(msg), ErrorMatches, "invalid parameter: .*")
+}
+
+func (s *TranslateTest) TestIncomingCtcp(c *C) {
+	p := incoming(c, ":alice!a@host PRIVMSG #iq :\x01ACTION waves\x01")
+	c.Check(p.GetCtcp(), DeepEquals, &ircproto.Ctcp{
+		Source:  &ircproto.Prefix{Name: "alice", User: "a", Host: "host"},
+		Target:  "#iq",
+		Command: "ACTION",
+		Params:  "waves",
+	})
+
+	// No closing delimiter.
+	p = incoming(c, ":alice!a@host PRIVMSG iq :\x01version")
+	c.Check(p.GetCtcp().GetCommand(), Equals, "VERSION")
+	c.Check(p.GetCtcp().GetParams(), Equals, "")
+
+	p = incoming(c, ":bob!b@host NOTICE iq :\x01PING 12345\x01")
+	c.Check(p.GetCtcp().GetReply(), Equals, true)
+	c.Check(p.GetCtcp().GetParams(), Equals, "12345")
+
+	// An empty CTCP is an ordinary message.
+	p = incoming(c, ":alice!a@host PRIVMSG iq :\x01\x01")
+	c.Check(p.GetPrivmsg().GetMessage(), Equals, "\x01\x01")
+}
+
+func (s *TranslateTest) TestOutgoingCtcp(c *C) {
+	msg := &ircproto.Message{
+		Payload: &ircproto.Message_Ctcp{Ctcp: &ircproto.Ctcp{
+			Target:  "#iq",
+			Command: "ACTION",
+			Params:  "waves",
+		}},
+	}
+	c.Check(incoming(c, roundTrip(c, msg)), DeepEquals, msg)
+	c.Check(outgoingLine(c, msg), Equals, "PRIVMSG #iq :\x01ACTION waves\x01")
+
+	msg.Payload = &ircproto.Message_Ctcp{Ctcp: &ircproto.Ctcp{
+		Target:  "alice",
+		Command: "version",
+		Reply:   true,
+	}}
+	c.Check(outgoingLine(c, msg), Equals, "NOTICE alice :\x01VERSION\x01")
+
+	msg.Payload = &ircproto.Message_Ctcp{Ctcp: &ircproto.Ctcp{Target: "alice"}}
+	c.Check(outgoingError(msg), ErrorMatches, "command must be specified")
+	msg.Payload = &ircproto.Message_Ctcp{Ctcp: &ircproto.Ctcp{
+		Target:  "alice",
+		Command: "ACTION",
+		Params:  "a\x01b",
+	}}
+	c.Check(outgoingError(msg), ErrorMatches, "invalid character in CTCP message")
+}
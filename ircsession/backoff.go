@@ -0,0 +1,104 @@
+package ircsession
+
+import (
+	"github.com/msparks/iq/ircconnection"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Policy for reconnecting after the connection is lost.
+type Backoff struct {
+	// Delay before the first attempt.
+	Initial time.Duration
+
+	// Upper bound on the delay.
+	Max time.Duration
+
+	// Factor the delay grows by after each failed attempt.
+	Multiplier float64
+
+	// Fraction of the delay to randomize by, in [0, 1]. A jitter of 0.2
+	// spreads the delay over +/-20%.
+	Jitter float64
+
+	// Attempts to make before giving up. Zero means retry forever.
+	MaxAttempts int
+}
+
+// Used when IRCSettings.Reconnect is the zero value.
+var DefaultBackoff = Backoff{
+	Initial:    5 * time.Second,
+	Max:        5 * time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Delivered to notifiees when a reconnect is scheduled or abandoned.
+type ReconnectNotification struct {
+	// Number of consecutive reconnect attempts, including the scheduled one.
+	Attempt int
+
+	// When the attempt will be made. Zero if we have given up.
+	Next time.Time
+}
+
+// Returns the delay before the given attempt, counting from 1. random
+// returns values in [0, 1).
+func (b Backoff) delay(attempt int, random func() float64) time.Duration {
+	if b.Initial <= 0 {
+		b.Initial = DefaultBackoff.Initial
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = 1
+	}
+
+	d := float64(b.Initial)
+	for i := 1; i < attempt; i++ {
+		d *= b.Multiplier
+		if b.Max > 0 && d >= float64(b.Max) {
+			break
+		}
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		d *= 1 + b.Jitter*(2*random()-1)
+	}
+	return time.Duration(d)
+}
+
+func (s *IRCSession) backoff() Backoff {
+	if s.settings.Reconnect == (Backoff{}) {
+		return DefaultBackoff
+	}
+	return s.settings.Reconnect
+}
+
+// Schedules the next reconnect attempt, unless we have run out of attempts.
+func (s *IRCSession) scheduleReconnect() {
+	b := s.backoff()
+	s.reconnectAttempts++
+
+	if b.MaxAttempts > 0 && s.reconnectAttempts > b.MaxAttempts {
+		log.Printf("Giving up after %d reconnect attempts.", b.MaxAttempts)
+		s.Notify(ReconnectNotification{Attempt: s.reconnectAttempts})
+		return
+	}
+
+	d := b.delay(s.reconnectAttempts, rand.Float64)
+	next := time.Now().Add(d)
+	log.Printf("Reconnecting in %s (attempt %d).", d, s.reconnectAttempts)
+	s.reconnectTimer = time.NewTimer(d)
+	s.Notify(ReconnectNotification{Attempt: s.reconnectAttempts, Next: next})
+}
+
+// Called when the reconnect timer fires.
+func (s *IRCSession) reconnect() {
+	s.reconnectTimer = nil
+	log.Printf("Reconnecting...")
+	s.setState(CONNECTING)
+	go s.Conn.StateIs(ircconnection.CONNECTING)
+}
@@ -0,0 +1,126 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type BackoffTest struct{}
+
+var _ = Suite(&BackoffTest{})
+
+func noJitter() float64 { return 0.5 }
+
+func (s *BackoffTest) TestDelay(c *C) {
+	b := Backoff{
+		Initial:    time.Second,
+		Max:        10 * time.Second,
+		Multiplier: 2,
+	}
+	var delays []time.Duration
+	for attempt := 1; attempt <= 6; attempt++ {
+		delays = append(delays, b.delay(attempt, noJitter))
+	}
+	c.Check(delays, DeepEquals, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		10 * time.Second, 10 * time.Second,
+	})
+}
+
+func (s *BackoffTest) TestJitter(c *C) {
+	b := Backoff{Initial: 10 * time.Second, Multiplier: 2, Jitter: 0.5}
+	c.Check(b.delay(1, func() float64 { return 0 }), Equals, 5*time.Second)
+	c.Check(b.delay(1, noJitter), Equals, 10*time.Second)
+	c.Check(b.delay(1, func() float64 { return 0.999 }) < 15*time.Second,
+		Equals, true)
+}
+
+func (s *BackoffTest) TestDefaults(c *C) {
+	// Invalid values are clamped.
+	b := Backoff{Multiplier: 0.5}
+	c.Check(b.delay(3, noJitter), Equals, DefaultBackoff.Initial)
+
+	session := &IRCSession{}
+	c.Check(session.backoff(), Equals, DefaultBackoff)
+}
+
+func (s *BackoffTest) TestReconnect(c *C) {
+	settings := testSettings
+	settings.Reconnect = Backoff{Initial: 10 * time.Millisecond}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	register(f)
+	waitFor(c, func() bool { return f.session.State() == CONNECTED })
+
+	// The server drops us; we reconnect after the initial delay.
+	start := time.Now()
+	f.peer.Close()
+	v := f.Notification(ReconnectNotification{}).(ReconnectNotification)
+	c.Check(v.Attempt, Equals, 1)
+	c.Check(v.Next.Before(start.Add(time.Second)), Equals, true)
+	f.Accept()
+	f.Expect("NICK iq")
+
+	// Registering resets the attempt count.
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test 001 iq :Welcome")
+	waitFor(c, func() bool { return f.session.State() == CONNECTED })
+	f.peer.Close()
+	v = f.Notification(ReconnectNotification{}).(ReconnectNotification)
+	c.Check(v.Attempt, Equals, 1)
+	f.Accept()
+	f.Expect("NICK iq")
+}
+
+func (s *BackoffTest) TestGiveUp(c *C) {
+	settings := testSettings
+	settings.Reconnect = Backoff{Initial: 10 * time.Millisecond, MaxAttempts: 2}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	f.listener.Close()
+
+	// Every attempt fails because nothing is listening.
+	f.peer.Close()
+	for attempt := 1; attempt <= 2; attempt++ {
+		v := f.Notification(ReconnectNotification{}).(ReconnectNotification)
+		c.Check(v.Attempt, Equals, attempt)
+		c.Check(v.Next.IsZero(), Equals, false)
+	}
+	v := f.Notification(ReconnectNotification{}).(ReconnectNotification)
+	c.Check(v.Attempt, Equals, 3)
+	c.Check(v.Next.IsZero(), Equals, true)
+	c.Check(f.session.State(), Equals, DISCONNECTED)
+}
+
+func (s *BackoffTest) TestRepeatedRefusals(c *C) {
+	settings := testSettings
+	settings.Reconnect = Backoff{Initial: time.Millisecond, MaxAttempts: 30}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	f.listener.Close()
+
+	// Many refused reconnects in quick succession, none of which may wedge
+	// the session.
+	f.peer.Close()
+	for {
+		v := f.Notification(ReconnectNotification{}).(ReconnectNotification)
+		if v.Next.IsZero() {
+			c.Check(v.Attempt, Equals, 31)
+			break
+		}
+	}
+	c.Check(f.session.State(), Equals, DISCONNECTED)
+}
+
+func (s *BackoffTest) TestDeliberateDisconnect(c *C) {
+	settings := testSettings
+	settings.Reconnect = Backoff{Initial: 10 * time.Millisecond}
+	f := newFakeServer(c, settings)
+	register(f)
+	f.Close()
+
+	// No reconnect is scheduled.
+	time.Sleep(50 * time.Millisecond)
+	c.Check(f.session.State(), Equals, DISCONNECTED)
+	c.Check(f.session.reconnectAttempts, Equals, 0)
+}
@@ -0,0 +1,240 @@
+package ircsession
+
+import (
+	"errors"
+	ircproto "github.com/msparks/iq/public/irc"
+	"log"
+	"sort"
+	"strings"
+)
+
+// CAP subcommands.
+const (
+	capLS   = "LS"
+	capLIST = "LIST"
+	capREQ  = "REQ"
+	capACK  = "ACK"
+	capNAK  = "NAK"
+	capNEW  = "NEW"
+	capDEL  = "DEL"
+	capEND  = "END"
+)
+
+// CAP protocol version we speak. 302 enables capability values and implies
+// cap-notify, so the server may send NEW and DEL at any time.
+const capVersion = "302"
+
+// Delivered to notifiees when the set of enabled capabilities changes.
+type CapabilityChangeNotification struct {
+	// The enabled capabilities, sorted.
+	Capabilities []string
+}
+
+// Returns the capabilities acknowledged by the server, sorted.
+func (s *IRCSession) Capabilities() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.capabilities()
+}
+
+// Returns whether the server has acknowledged the capability.
+func (s *IRCSession) HasCapability(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enabledCaps[name]
+}
+
+// Returns the value the server advertised for a capability, e.g. the list of
+// mechanisms for "sasl". ok is false if the capability is not available.
+func (s *IRCSession) AvailableCapability(name string) (value string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok = s.availableCaps[name]
+	return value, ok
+}
+
+// s.mu must be held.
+func (s *IRCSession) capabilities() []string {
+	var caps []string
+	for name := range s.enabledCaps {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// Returns the capabilities to request from the server.
+func (s *IRCSession) wantedCaps() []string {
+	caps := s.settings.Capabilities
+	if s.saslEnabled() {
+		for _, name := range caps {
+			if name == "sasl" {
+				return caps
+			}
+		}
+		caps = append(caps[:len(caps):len(caps)], "sasl")
+	}
+	return caps
+}
+
+func capMessage(subcommand string, caps ...string) *ircproto.Message {
+	return &ircproto.Message{
+		Payload: &ircproto.Message_Cap{Cap: &ircproto.Cap{
+			Subcommand:   subcommand,
+			Capabilities: caps,
+		}},
+	}
+}
+
+// Starts capability negotiation, which suspends registration until CAP END.
+// Does nothing if no capabilities are wanted.
+func (s *IRCSession) startCapNegotiation() {
+	s.mu.Lock()
+	s.availableCaps = make(map[string]string)
+	s.enabledCaps = make(map[string]bool)
+	s.account = ""
+	s.mu.Unlock()
+	s.capPending = 0
+	s.authenticating = false
+
+	if len(s.wantedCaps()) == 0 {
+		s.negotiating = false
+		return
+	}
+	s.negotiating = true
+	ls := capMessage(capLS)
+	ls.GetCap().Version = capVersion
+	s.send(ls)
+}
+
+// Ends capability negotiation, allowing registration to complete.
+func (s *IRCSession) endCapNegotiation() {
+	if !s.negotiating {
+		return
+	}
+	s.negotiating = false
+	s.send(capMessage(capEND))
+}
+
+// Finishes negotiation once every request has been answered and SASL, if
+// any, is done.
+func (s *IRCSession) maybeEndCapNegotiation() {
+	if s.negotiating && s.capPending == 0 && !s.authenticating {
+		s.endCapNegotiation()
+	}
+}
+
+// Requests the wanted capabilities that are available but not yet enabled.
+// Returns false if there was nothing to request.
+func (s *IRCSession) requestCaps() bool {
+	var req []string
+	s.mu.Lock()
+	for _, name := range s.wantedCaps() {
+		if _, ok := s.availableCaps[name]; ok && !s.enabledCaps[name] {
+			req = append(req, name)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(req) == 0 {
+		return false
+	}
+	log.Printf("Requesting capabilities: %s", strings.Join(req, " "))
+	s.capPending++
+	s.send(capMessage(capREQ, req...))
+	return true
+}
+
+func (s *IRCSession) onCap(c *ircproto.Cap) {
+	switch c.GetSubcommand() {
+	case capLS, capNEW:
+		s.mu.Lock()
+		for _, token := range c.GetCapabilities() {
+			name, value := token, ""
+			if i := strings.Index(token, "="); i >= 0 {
+				name, value = token[:i], token[i+1:]
+			}
+			s.availableCaps[name] = value
+		}
+		s.mu.Unlock()
+
+		if c.GetMore() {
+			// Wait for the rest of the list.
+			return
+		}
+		s.requestCaps()
+		if s.negotiating && s.saslEnabled() {
+			if _, ok := s.AvailableCapability("sasl"); !ok {
+				s.saslFailed(errors.New("Server does not support SASL"))
+				return
+			}
+		}
+		s.maybeEndCapNegotiation()
+
+	case capACK:
+		s.mu.Lock()
+		for _, name := range c.GetCapabilities() {
+			if strings.HasPrefix(name, "-") {
+				delete(s.enabledCaps, name[1:])
+			} else {
+				s.enabledCaps[name] = true
+			}
+		}
+		caps := s.capabilities()
+		s.mu.Unlock()
+
+		log.Printf("Capabilities enabled: %s", strings.Join(caps, " "))
+		s.Notify(CapabilityChangeNotification{Capabilities: caps})
+		if s.negotiating && s.saslEnabled() && hasCap(c, "sasl") {
+			s.startSASL()
+		}
+		s.onCapReply()
+
+	case capNAK:
+		log.Printf("Capabilities rejected: %s",
+			strings.Join(c.GetCapabilities(), " "))
+		if s.negotiating && s.saslEnabled() && hasCap(c, "sasl") {
+			s.saslFailed(errors.New("Server refused the sasl capability"))
+		}
+		s.onCapReply()
+
+	case capDEL:
+		changed := false
+		s.mu.Lock()
+		for _, name := range c.GetCapabilities() {
+			delete(s.availableCaps, name)
+			if s.enabledCaps[name] {
+				delete(s.enabledCaps, name)
+				changed = true
+			}
+		}
+		caps := s.capabilities()
+		s.mu.Unlock()
+
+		if changed {
+			log.Printf("Capabilities enabled: %s", strings.Join(caps, " "))
+			s.Notify(CapabilityChangeNotification{Capabilities: caps})
+		}
+
+	default:
+		log.Printf("Ignoring CAP %s", c.GetSubcommand())
+	}
+}
+
+// Handles the server's answer to one of our requests.
+func (s *IRCSession) onCapReply() {
+	if s.capPending > 0 {
+		s.capPending--
+	}
+	s.maybeEndCapNegotiation()
+}
+
+// Returns whether a CAP message lists the named capability.
+func hasCap(c *ircproto.Cap, name string) bool {
+	for _, token := range c.GetCapabilities() {
+		if token == name || strings.HasPrefix(token, name+"=") {
+			return true
+		}
+	}
+	return false
+}
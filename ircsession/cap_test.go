@@ -0,0 +1,107 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type CapTest struct{}
+
+var _ = Suite(&CapTest{})
+
+func (s *CapTest) TestNegotiate(c *C) {
+	settings := testSettings
+	settings.Capabilities = []string{"server-time", "multi-prefix", "away-notify"}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	f.Expect("CAP LS 302")
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+
+	// Multi-line LS. Only what we want and the server offers is requested.
+	f.Send(":irc.test CAP * LS * :multi-prefix sasl=PLAIN")
+	f.Send(":irc.test CAP * LS :server-time extended-join")
+	f.Expect("CAP REQ :server-time multi-prefix")
+
+	f.Send(":irc.test CAP * ACK :server-time multi-prefix")
+	f.Expect("CAP END")
+
+	waitFor(c, func() bool { return len(f.session.Capabilities()) == 2 })
+	c.Check(f.session.Capabilities(), DeepEquals,
+		[]string{"multi-prefix", "server-time"})
+	c.Check(f.session.HasCapability("server-time"), Equals, true)
+	c.Check(f.session.HasCapability("away-notify"), Equals, false)
+
+	value, ok := f.session.AvailableCapability("sasl")
+	c.Check(ok, Equals, true)
+	c.Check(value, Equals, "PLAIN")
+	_, ok = f.session.AvailableCapability("away-notify")
+	c.Check(ok, Equals, false)
+}
+
+func (s *CapTest) TestNothingToRequest(c *C) {
+	settings := testSettings
+	settings.Capabilities = []string{"server-time"}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	f.Expect("CAP LS 302")
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+
+	f.Send(":irc.test CAP * LS :multi-prefix")
+	f.Expect("CAP END")
+}
+
+func (s *CapTest) TestNak(c *C) {
+	settings := testSettings
+	settings.Capabilities = []string{"server-time"}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	f.Expect("CAP LS 302")
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+
+	f.Send(":irc.test CAP * LS :server-time")
+	f.Expect("CAP REQ :server-time")
+	f.Send(":irc.test CAP * NAK :server-time")
+	f.Expect("CAP END")
+	c.Check(f.session.Capabilities(), HasLen, 0)
+}
+
+func (s *CapTest) TestNewAndDel(c *C) {
+	settings := testSettings
+	settings.Capabilities = []string{"server-time", "away-notify"}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	f.Expect("CAP LS 302")
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test CAP * LS :server-time")
+	f.Expect("CAP REQ :server-time")
+	f.Send(":irc.test CAP * ACK :server-time")
+	f.Expect("CAP END")
+	v := f.Notification(
+		CapabilityChangeNotification{}).(CapabilityChangeNotification)
+	c.Check(v.Capabilities, DeepEquals, []string{"server-time"})
+	f.Send(":irc.test 001 iq :Welcome")
+
+	// A newly offered capability we want is requested after registration.
+	f.Send(":irc.test CAP iq NEW :away-notify echo-message")
+	f.Expect("CAP REQ :away-notify")
+	f.Send(":irc.test CAP iq ACK :away-notify")
+	v = f.Notification(
+		CapabilityChangeNotification{}).(CapabilityChangeNotification)
+	c.Check(v.Capabilities, DeepEquals, []string{"away-notify", "server-time"})
+
+	// Withdrawn capabilities are disabled.
+	f.Send(":irc.test CAP iq DEL :server-time")
+	v = f.Notification(
+		CapabilityChangeNotification{}).(CapabilityChangeNotification)
+	c.Check(v.Capabilities, DeepEquals, []string{"away-notify"})
+	c.Check(f.session.HasCapability("server-time"), Equals, false)
+	_, ok := f.session.AvailableCapability("server-time")
+	c.Check(ok, Equals, false)
+}
@@ -0,0 +1,508 @@
+package ircsession
+
+import (
+	"github.com/msparks/iq/ircconnection"
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A channel we are in.
+type Channel struct {
+	Name string
+
+	Topic string
+	// Who set the topic and when, if known. SetBy may be a nick or a full
+	// nick!user@host.
+	TopicSetBy string
+	TopicSetAt time.Time
+
+	// Channel modes that are set, with their parameters. Modes without a
+	// parameter map to "". List modes such as bans are not included.
+	Modes map[byte]string
+
+	// Members, keyed by casefolded nick.
+	Members map[string]Member
+
+	// Whether the member list from NAMES is complete.
+	Synced bool
+
+	// Ban, ban exception and invite exception lists, keyed by mode. Only
+	// lists fetched with RequestList (or a MODE query sent another way)
+	// are present.
+	Lists map[byte][]ListEntry
+}
+
+// A member of a channel.
+type Member struct {
+	Nick string
+
+	// Membership modes, highest first, e.g. "ov".
+	Modes string
+}
+
+// Returns the prefix symbol of the member's highest mode, e.g. "@", or ""
+// if it has none.
+func (m Member) Prefix(isupport ISupport) string {
+	if m.Modes == "" {
+		return ""
+	}
+	i := strings.IndexByte(isupport.PrefixModes, m.Modes[0])
+	if i < 0 || i >= len(isupport.PrefixSymbols) {
+		return ""
+	}
+	return isupport.PrefixSymbols[i : i+1]
+}
+
+// What changed in a channel.
+type ChannelChange string
+
+const (
+	// We joined the channel.
+	ChannelJoined ChannelChange = "JOINED"
+
+	// We left the channel, were kicked or were disconnected.
+	ChannelParted ChannelChange = "PARTED"
+
+	// The member list was received, or a member joined, left, changed
+	// nick or had its membership modes changed.
+	ChannelMembersChanged ChannelChange = "MEMBERS"
+
+	// The channel modes changed.
+	ChannelModesChanged ChannelChange = "MODES"
+
+	// The topic or its metadata changed.
+	ChannelTopicChanged ChannelChange = "TOPIC"
+)
+
+// Delivered to notifiees when a channel we are in changes. Use Channel for
+// the new state.
+type ChannelNotification struct {
+	Channel string
+	Change  ChannelChange
+
+	// The nick of the member concerned, for member changes caused by one
+	// member. For nick changes, the new nick.
+	Nick string
+}
+
+// Returns the names of the channels we are in, sorted.
+func (s *IRCSession) Channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, ch := range s.channels {
+		names = append(names, ch.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns a snapshot of a channel we are in. ok is false if we are not in
+// it.
+func (s *IRCSession) Channel(name string) (ch Channel, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.channels[s.isupport.Fold(name)]
+	if c == nil {
+		return Channel{}, false
+	}
+	return c.copy(), true
+}
+
+func (ch *Channel) copy() Channel {
+	c := *ch
+	c.Modes = make(map[byte]string, len(ch.Modes))
+	for k, v := range ch.Modes {
+		c.Modes[k] = v
+	}
+	c.Members = make(map[string]Member, len(ch.Members))
+	for k, v := range ch.Members {
+		c.Members[k] = v
+	}
+	c.Lists = make(map[byte][]ListEntry, len(ch.Lists))
+	for k, v := range ch.Lists {
+		c.Lists[k] = copyList(v)
+	}
+	return c
+}
+
+// Returns the parameters of a reply, including the trailing one if set.
+func replyParams(r *ircproto.Reply) []string {
+	params := r.GetParams()
+	if r.GetTrailing() != "" {
+		params = append(params[:len(params):len(params)], r.GetTrailing())
+	}
+	return params
+}
+
+// Returns whether nick is our own nick. s.mu must be held.
+func (s *IRCSession) isOwnNick(nick string) bool {
+	return s.isupport.Equal(nick, s.nick)
+}
+
+// Calls update with s.mu held, then delivers the notifications it returns.
+func (s *IRCSession) updateChannels(update func() []ChannelNotification) {
+	s.mu.Lock()
+	notifications := update()
+	s.mu.Unlock()
+	for _, n := range notifications {
+		s.Notify(n)
+	}
+}
+
+// Tracks channel state from an incoming message.
+func (s *IRCSession) onChannelMessage(msg *ircproto.Message, t time.Time) {
+	switch p := msg.GetPayload().(type) {
+	case *ircproto.Message_Join:
+		s.updateChannels(func() []ChannelNotification {
+			return s.onJoin(p.Join)
+		})
+	case *ircproto.Message_Part:
+		s.updateChannels(func() []ChannelNotification {
+			nick := p.Part.GetSource().GetName()
+			var ns []ChannelNotification
+			for _, name := range p.Part.GetChannels() {
+				ns = append(ns, s.removeMember(name, nick)...)
+			}
+			return ns
+		})
+	case *ircproto.Message_Kick:
+		s.updateChannels(func() []ChannelNotification {
+			return s.removeMember(p.Kick.GetChannel(), p.Kick.GetNick())
+		})
+	case *ircproto.Message_Quit:
+		s.updateChannels(func() []ChannelNotification {
+			return s.onQuit(p.Quit.GetSource().GetName())
+		})
+	case *ircproto.Message_Nick:
+		s.updateChannels(func() []ChannelNotification {
+			return s.renameMember(p.Nick.GetSource().GetName(), p.Nick.GetNewNick())
+		})
+	case *ircproto.Message_Mode:
+		var modes *ModeNotification
+		s.updateChannels(func() []ChannelNotification {
+			var ns []ChannelNotification
+			ns, modes = s.onMode(p.Mode, t)
+			return ns
+		})
+		if modes != nil {
+			s.Notify(*modes)
+			s.onListModes(*modes)
+		}
+	case *ircproto.Message_Topic:
+		s.updateChannels(func() []ChannelNotification {
+			return s.setTopic(p.Topic.GetChannel(), p.Topic.GetTopic(),
+				p.Topic.GetSource().GetName(), t)
+		})
+	case *ircproto.Message_Reply:
+		s.onChannelReply(p.Reply)
+		s.onListReply(p.Reply)
+	}
+}
+
+// Tracks channel state from a numeric reply.
+func (s *IRCSession) onChannelReply(r *ircproto.Reply) {
+	switch r.GetNumeric() {
+	case irc.RPL_NAMREPLY:
+		names := r.GetNames()
+		if names == nil {
+			return
+		}
+		s.updateChannels(func() []ChannelNotification {
+			s.addNames(names)
+			return nil
+		})
+
+	case irc.RPL_ENDOFNAMES:
+		end := r.GetEndOfList()
+		if end == nil {
+			return
+		}
+		s.updateChannels(func() []ChannelNotification {
+			ch := s.channels[s.isupport.Fold(end.GetTarget())]
+			if ch == nil {
+				return nil
+			}
+			ch.Synced = true
+			s.namesPending[s.isupport.Fold(ch.Name)] = false
+			return []ChannelNotification{{
+				Channel: ch.Name, Change: ChannelMembersChanged}}
+		})
+
+	case irc.RPL_TOPIC, irc.RPL_NOTOPIC:
+		topic := r.GetTopic()
+		if topic == nil {
+			return
+		}
+		s.updateChannels(func() []ChannelNotification {
+			ch := s.channels[s.isupport.Fold(topic.GetChannel())]
+			if ch == nil {
+				return nil
+			}
+			ch.Topic = topic.GetTopic()
+			if ch.Topic == "" {
+				ch.TopicSetBy, ch.TopicSetAt = "", time.Time{}
+			}
+			return []ChannelNotification{{
+				Channel: ch.Name, Change: ChannelTopicChanged}}
+		})
+
+	case ircconnection.RPL_TOPICWHOTIME:
+		topic := r.GetTopic()
+		if topic == nil {
+			return
+		}
+		s.updateChannels(func() []ChannelNotification {
+			ch := s.channels[s.isupport.Fold(topic.GetChannel())]
+			if ch == nil {
+				return nil
+			}
+			ch.TopicSetBy = topic.GetSetBy()
+			ch.TopicSetAt = time.Unix(topic.GetSetAt(), 0)
+			return []ChannelNotification{{
+				Channel: ch.Name, Change: ChannelTopicChanged}}
+		})
+
+	case irc.RPL_CHANNELMODEIS:
+		// <client> <channel> <modes> [<args>...]
+		params := replyParams(r)
+		if len(params) < 3 {
+			return
+		}
+		s.updateChannels(func() []ChannelNotification {
+			ch := s.channels[s.isupport.Fold(params[1])]
+			if ch == nil {
+				return nil
+			}
+			ch.Modes = make(map[byte]string)
+			s.applyModes(ch, s.isupport.ParseModes(params[2], params[3:]))
+			return []ChannelNotification{{
+				Channel: ch.Name, Change: ChannelModesChanged}}
+		})
+	}
+}
+
+// s.mu must be held.
+func (s *IRCSession) onJoin(join *ircproto.Join) []ChannelNotification {
+	nick := join.GetSource().GetName()
+	var ns []ChannelNotification
+	for _, name := range join.GetChannels() {
+		key := s.isupport.Fold(name)
+		if s.isOwnNick(nick) {
+			s.channels[key] = &Channel{
+				Name:    name,
+				Modes:   make(map[byte]string),
+				Members: make(map[string]Member),
+				Lists:   make(map[byte][]ListEntry),
+			}
+			ns = append(ns, ChannelNotification{
+				Channel: name, Change: ChannelJoined, Nick: nick})
+		}
+		ch := s.channels[key]
+		if ch == nil {
+			continue
+		}
+		ch.Members[s.isupport.Fold(nick)] = Member{Nick: nick}
+		if !s.isOwnNick(nick) {
+			ns = append(ns, ChannelNotification{
+				Channel: ch.Name, Change: ChannelMembersChanged, Nick: nick})
+		}
+	}
+	return ns
+}
+
+// Removes nick from a channel, or the channel if nick is us. s.mu must be
+// held.
+func (s *IRCSession) removeMember(channel, nick string) []ChannelNotification {
+	key := s.isupport.Fold(channel)
+	ch := s.channels[key]
+	if ch == nil {
+		return nil
+	}
+	if s.isOwnNick(nick) {
+		delete(s.channels, key)
+		delete(s.namesPending, key)
+		s.clearPendingLists(key)
+		return []ChannelNotification{{
+			Channel: ch.Name, Change: ChannelParted, Nick: nick}}
+	}
+	delete(ch.Members, s.isupport.Fold(nick))
+	return []ChannelNotification{{
+		Channel: ch.Name, Change: ChannelMembersChanged, Nick: nick}}
+}
+
+// Removes nick from every channel. s.mu must be held.
+func (s *IRCSession) onQuit(nick string) []ChannelNotification {
+	var ns []ChannelNotification
+	key := s.isupport.Fold(nick)
+	for _, ch := range s.channels {
+		if _, ok := ch.Members[key]; ok {
+			delete(ch.Members, key)
+			ns = append(ns, ChannelNotification{
+				Channel: ch.Name, Change: ChannelMembersChanged, Nick: nick})
+		}
+	}
+	return ns
+}
+
+// Renames a member in every channel. s.mu must be held.
+func (s *IRCSession) renameMember(oldNick, newNick string) []ChannelNotification {
+	var ns []ChannelNotification
+	oldKey, newKey := s.isupport.Fold(oldNick), s.isupport.Fold(newNick)
+	for _, ch := range s.channels {
+		m, ok := ch.Members[oldKey]
+		if !ok {
+			continue
+		}
+		delete(ch.Members, oldKey)
+		m.Nick = newNick
+		ch.Members[newKey] = m
+		ns = append(ns, ChannelNotification{
+			Channel: ch.Name, Change: ChannelMembersChanged, Nick: newNick})
+	}
+	return ns
+}
+
+// Returns the notifications for a MODE message, including the changes
+// themselves if the target is a channel we are in. s.mu must be held.
+func (s *IRCSession) onMode(mode *ircproto.Mode, t time.Time) ([]ChannelNotification, *ModeNotification) {
+	ch := s.channels[s.isupport.Fold(mode.GetTarget())]
+	if ch == nil {
+		// A user mode, or a channel we are not in.
+		return nil, nil
+	}
+	changes := s.isupport.ParseModes(mode.GetModes(), mode.GetArgs())
+	members, modes := s.applyModes(ch, changes)
+	var ns []ChannelNotification
+	for _, nick := range members {
+		ns = append(ns, ChannelNotification{
+			Channel: ch.Name, Change: ChannelMembersChanged, Nick: nick})
+	}
+	if modes {
+		ns = append(ns, ChannelNotification{
+			Channel: ch.Name, Change: ChannelModesChanged})
+	}
+	return ns, &ModeNotification{
+		Channel: ch.Name,
+		Source:  mode.GetSource().GetName(),
+		Changes: changes,
+		Time:    t,
+	}
+}
+
+// Applies mode changes to a channel. Returns the nicks of members whose
+// modes changed, and whether the channel modes changed. s.mu must be held.
+func (s *IRCSession) applyModes(ch *Channel, changes []ModeChange) (members []string, changed bool) {
+	for _, c := range changes {
+		switch {
+		case c.Type == ModeTypeMembership:
+			key := s.isupport.Fold(c.Arg)
+			m, ok := ch.Members[key]
+			if !ok {
+				continue
+			}
+			m.Modes = setMemberMode(s.isupport, m.Modes, c.Mode, c.Add)
+			ch.Members[key] = m
+			members = append(members, m.Nick)
+
+		case c.Type == ModeTypeList:
+			// See onListModes.
+
+		case c.Add:
+			ch.Modes[c.Mode] = c.Arg
+			changed = true
+
+		default:
+			delete(ch.Modes, c.Mode)
+			changed = true
+		}
+	}
+	return members, changed
+}
+
+// Adds or removes a membership mode, keeping them in PREFIX order.
+func setMemberMode(isupport ISupport, modes string, mode byte, add bool) string {
+	var b []byte
+	for i := 0; i < len(isupport.PrefixModes); i++ {
+		m := isupport.PrefixModes[i]
+		has := strings.IndexByte(modes, m) >= 0
+		if m == mode {
+			has = add
+		}
+		if has {
+			b = append(b, m)
+		}
+	}
+	return string(b)
+}
+
+// Adds the members in a NAMES reply. The first reply after the list was
+// complete starts a new list. s.mu must be held.
+func (s *IRCSession) addNames(names *ircproto.NamesReply) {
+	key := s.isupport.Fold(names.GetChannel())
+	ch := s.channels[key]
+	if ch == nil {
+		return
+	}
+	if !s.namesPending[key] {
+		ch.Members = make(map[string]Member)
+		s.namesPending[key] = true
+	}
+	for _, name := range names.GetNames() {
+		m := parseMember(s.isupport, name)
+		ch.Members[s.isupport.Fold(m.Nick)] = m
+	}
+}
+
+// Parses a name from NAMES such as "@+alice" or, with userhost-in-names,
+// "@alice!a@host".
+func parseMember(isupport ISupport, name string) Member {
+	var prefixModes []byte
+	for name != "" {
+		i := strings.IndexByte(isupport.PrefixSymbols, name[0])
+		if i < 0 {
+			break
+		}
+		prefixModes = append(prefixModes, isupport.PrefixModes[i])
+		name = name[1:]
+	}
+	if i := strings.IndexByte(name, '!'); i >= 0 {
+		name = name[:i]
+	}
+	m := Member{Nick: name}
+	for _, mode := range prefixModes {
+		m.Modes = setMemberMode(isupport, m.Modes, mode, true)
+	}
+	return m
+}
+
+// Sets the topic of a channel. s.mu must be held.
+func (s *IRCSession) setTopic(channel, topic, setBy string, t time.Time) []ChannelNotification {
+	ch := s.channels[s.isupport.Fold(channel)]
+	if ch == nil {
+		return nil
+	}
+	ch.Topic = topic
+	ch.TopicSetBy = setBy
+	ch.TopicSetAt = t
+	return []ChannelNotification{{
+		Channel: ch.Name, Change: ChannelTopicChanged, Nick: setBy}}
+}
+
+// Forgets all channels, as when disconnected.
+func (s *IRCSession) clearChannels() {
+	s.updateChannels(func() []ChannelNotification {
+		var ns []ChannelNotification
+		for _, ch := range s.channels {
+			ns = append(ns, ChannelNotification{
+				Channel: ch.Name, Change: ChannelParted, Nick: s.nick})
+		}
+		s.channels = make(map[string]*Channel)
+		s.namesPending = make(map[string]bool)
+		s.listsPending = make(map[listKey][]ListEntry)
+		return ns
+	})
+}
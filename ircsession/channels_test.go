@@ -0,0 +1,148 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type ChannelsTest struct{}
+
+var _ = Suite(&ChannelsTest{})
+
+// Waits for a channel notification with the given change.
+func (f *fakeServer) ChannelNotification(change ChannelChange) ChannelNotification {
+	for {
+		v := f.Notification(ChannelNotification{}).(ChannelNotification)
+		if v.Change == change {
+			return v
+		}
+	}
+}
+
+// Registers and joins #iq with alice (an operator) and bob in it.
+func joinIQ(f *fakeServer) {
+	register(f)
+	f.Send(":irc.test 005 iq PREFIX=(qov)~@+ CHANMODES=beI,k,l,imnst :are supported by this server")
+	f.Send(":iq!iq@host JOIN #iq")
+	f.ChannelNotification(ChannelJoined)
+	f.Send(":irc.test 332 iq #iq :Welcome to #iq")
+	f.Send(":irc.test 333 iq #iq alice!a@host 1400000000")
+	f.Send(":irc.test 353 iq = #iq :iq @alice")
+	f.Send(":irc.test 353 iq = #iq :+bob")
+	f.Send(":irc.test 366 iq #iq :End of /NAMES list.")
+	f.ChannelNotification(ChannelMembersChanged)
+}
+
+func (s *ChannelsTest) TestJoin(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	c.Check(f.session.Channels(), DeepEquals, []string{"#iq"})
+	ch, ok := f.session.Channel("#IQ")
+	c.Assert(ok, Equals, true)
+	c.Check(ch.Name, Equals, "#iq")
+	c.Check(ch.Synced, Equals, true)
+	c.Check(ch.Topic, Equals, "Welcome to #iq")
+	c.Check(ch.TopicSetBy, Equals, "alice!a@host")
+	c.Check(ch.TopicSetAt, Equals, time.Unix(1400000000, 0))
+	c.Check(ch.Members, DeepEquals, map[string]Member{
+		"iq":    {Nick: "iq"},
+		"alice": {Nick: "alice", Modes: "o"},
+		"bob":   {Nick: "bob", Modes: "v"},
+	})
+	c.Check(ch.Members["alice"].Prefix(f.session.ISupport()), Equals, "@")
+
+	_, ok = f.session.Channel("#other")
+	c.Check(ok, Equals, false)
+}
+
+func (s *ChannelsTest) TestMembers(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	f.Send(":carol!c@host JOIN #iq")
+	v := f.ChannelNotification(ChannelMembersChanged)
+	c.Check(v.Channel, Equals, "#iq")
+	c.Check(v.Nick, Equals, "carol")
+
+	f.Send(":Carol!c@host NICK dave")
+	c.Check(f.ChannelNotification(ChannelMembersChanged).Nick, Equals, "dave")
+	f.Send(":bob!b@host PART #iq :Bye")
+	c.Check(f.ChannelNotification(ChannelMembersChanged).Nick, Equals, "bob")
+	f.Send(":alice!a@host KICK #iq dave :No")
+	c.Check(f.ChannelNotification(ChannelMembersChanged).Nick, Equals, "dave")
+	f.Send(":alice!a@host QUIT :Gone")
+	c.Check(f.ChannelNotification(ChannelMembersChanged).Nick, Equals, "alice")
+
+	ch, _ := f.session.Channel("#iq")
+	c.Check(ch.Members, DeepEquals, map[string]Member{"iq": {Nick: "iq"}})
+}
+
+func (s *ChannelsTest) TestModes(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	f.Send(":irc.test 324 iq #iq +nk secret")
+	f.ChannelNotification(ChannelModesChanged)
+	ch, _ := f.session.Channel("#iq")
+	c.Check(ch.Modes, DeepEquals, map[byte]string{'n': "", 'k': "secret"})
+
+	// Membership modes stay in PREFIX order. Bans are not channel modes.
+	f.Send(":alice!a@host MODE #iq +vb-k+lq bob *!*@spam secret 10 bob")
+	f.ChannelNotification(ChannelModesChanged)
+	ch, _ = f.session.Channel("#iq")
+	c.Check(ch.Modes, DeepEquals, map[byte]string{'n': "", 'l': "10"})
+	c.Check(ch.Members["bob"].Modes, Equals, "qv")
+
+	f.Send(":alice!a@host MODE #iq -q+o bob iq")
+	f.ChannelNotification(ChannelMembersChanged)
+	f.ChannelNotification(ChannelMembersChanged)
+	ch, _ = f.session.Channel("#iq")
+	c.Check(ch.Members["bob"].Modes, Equals, "v")
+	c.Check(ch.Members["iq"].Modes, Equals, "o")
+}
+
+func (s *ChannelsTest) TestTopic(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	when := time.Date(2014, 5, 13, 12, 0, 0, 0, time.UTC)
+	f.Send("@time=2014-05-13T12:00:00.000Z :alice!a@host TOPIC #iq :New topic")
+	v := f.ChannelNotification(ChannelTopicChanged)
+	c.Check(v.Nick, Equals, "alice")
+	ch, _ := f.session.Channel("#iq")
+	c.Check(ch.Topic, Equals, "New topic")
+	c.Check(ch.TopicSetBy, Equals, "alice")
+	c.Check(ch.TopicSetAt.Equal(when), Equals, true)
+}
+
+func (s *ChannelsTest) TestPart(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	f.Send(":IQ!iq@host PART #iq")
+	v := f.ChannelNotification(ChannelParted)
+	c.Check(v.Channel, Equals, "#iq")
+	c.Check(f.session.Channels(), IsNil)
+}
+
+func (s *ChannelsTest) TestNamesRefresh(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	// A later NAMES reply replaces the member list.
+	f.Send(":irc.test 353 iq = #iq :@iq alice!a@host")
+	f.Send(":irc.test 366 iq #iq :End of /NAMES list.")
+	f.ChannelNotification(ChannelMembersChanged)
+	ch, _ := f.session.Channel("#iq")
+	c.Check(ch.Members, DeepEquals, map[string]Member{
+		"iq":    {Nick: "iq", Modes: "o"},
+		"alice": {Nick: "alice"},
+	})
+}
@@ -0,0 +1,76 @@
+package ircsession
+
+import (
+	ircproto "github.com/msparks/iq/public/irc"
+	"time"
+)
+
+// Default reply to CTCP VERSION.
+const DefaultCTCPVersion = "iq"
+
+// Default minimum time between CTCP replies to one sender.
+const defaultCTCPInterval = 2 * time.Second
+
+// CTCP queries we answer, for CLIENTINFO. ACTION is understood but not
+// answered.
+const ctcpClientInfo = "ACTION CLIENTINFO PING TIME VERSION"
+
+// Answers a CTCP query. Senders are answered at most once per
+// CTCPInterval, so that floods of queries don't get us disconnected for
+// flooding in turn.
+func (s *IRCSession) onCtcp(ctcp *ircproto.Ctcp) {
+	sender := ctcp.GetSource().GetName()
+	if ctcp.GetReply() || sender == "" || s.isSelf(sender) {
+		return
+	}
+
+	var params string
+	switch ctcp.GetCommand() {
+	case "VERSION":
+		params = s.settings.CTCPVersion
+		if params == "" {
+			params = DefaultCTCPVersion
+		}
+	case "PING":
+		params = ctcp.GetParams()
+	case "TIME":
+		params = time.Now().Format(time.RFC1123Z)
+	case "CLIENTINFO":
+		params = ctcpClientInfo
+	default:
+		return
+	}
+
+	if !s.allowCtcpReply(sender) {
+		return
+	}
+	s.send(&ircproto.Message{
+		Payload: &ircproto.Message_Ctcp{Ctcp: &ircproto.Ctcp{
+			Target:  sender,
+			Command: ctcp.GetCommand(),
+			Params:  params,
+			Reply:   true,
+		}},
+	})
+}
+
+// Returns whether we may answer a CTCP query from nick, and if so records
+// that we did.
+func (s *IRCSession) allowCtcpReply(nick string) bool {
+	interval := s.settings.CTCPInterval
+	if interval <= 0 {
+		interval = defaultCTCPInterval
+	}
+	now := time.Now()
+	for n, t := range s.ctcpReplied {
+		if now.Sub(t) >= interval {
+			delete(s.ctcpReplied, n)
+		}
+	}
+	key := s.ISupport().Fold(nick)
+	if _, ok := s.ctcpReplied[key]; ok {
+		return false
+	}
+	s.ctcpReplied[key] = now
+	return true
+}
@@ -0,0 +1,64 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+	"strings"
+	"time"
+)
+
+type CTCPTest struct{}
+
+var _ = Suite(&CTCPTest{})
+
+func (s *CTCPTest) TestReplies(c *C) {
+	settings := testSettings
+	settings.CTCPVersion = "iq 1.0"
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	register(f)
+
+	f.Send(":alice!a@host PRIVMSG iq :\x01VERSION\x01")
+	f.Expect("NOTICE alice :\x01VERSION iq 1.0\x01")
+	f.Send(":bob!b@host PRIVMSG #iq :\x01PING 12345\x01")
+	f.Expect("NOTICE bob :\x01PING 12345\x01")
+	f.Send(":carol!c@host PRIVMSG iq :\x01CLIENTINFO\x01")
+	f.Expect("NOTICE carol :\x01CLIENTINFO " + ctcpClientInfo + "\x01")
+
+	f.Send(":dave!d@host PRIVMSG iq :\x01TIME\x01")
+	line := f.Next()
+	prefix := "NOTICE dave :\x01TIME "
+	c.Assert(strings.HasPrefix(line, prefix), Equals, true)
+	_, err := time.Parse(time.RFC1123Z, strings.Trim(line[len(prefix):], "\x01"))
+	c.Check(err, IsNil)
+}
+
+func (s *CTCPTest) TestIgnored(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	register(f)
+
+	// Actions, replies and unknown queries are not answered.
+	f.Send(":alice!a@host PRIVMSG #iq :\x01ACTION waves\x01")
+	f.Send(":alice!a@host NOTICE iq :\x01VERSION other\x01")
+	f.Send(":alice!a@host PRIVMSG iq :\x01DCC SEND file 0 0\x01")
+	f.Send(":bob!b@host PRIVMSG iq :\x01VERSION\x01")
+	f.Expect("NOTICE bob :\x01VERSION " + DefaultCTCPVersion + "\x01")
+}
+
+func (s *CTCPTest) TestRateLimit(c *C) {
+	settings := testSettings
+	settings.CTCPInterval = 100 * time.Millisecond
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	register(f)
+
+	f.Send(":alice!a@host PRIVMSG iq :\x01PING 1\x01")
+	f.Expect("NOTICE alice :\x01PING 1\x01")
+	f.Send(":Alice!a@host PRIVMSG iq :\x01PING 2\x01")
+	f.Send(":bob!b@host PRIVMSG iq :\x01PING 3\x01")
+	f.Expect("NOTICE bob :\x01PING 3\x01")
+
+	time.Sleep(100 * time.Millisecond)
+	f.Send(":alice!a@host PRIVMSG iq :\x01PING 4\x01")
+	f.Expect("NOTICE alice :\x01PING 4\x01")
+}
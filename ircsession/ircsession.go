@@ -2,7 +2,6 @@
 package ircsession
 
 import (
-	"code.google.com/p/goprotobuf/proto"
 	"github.com/msparks/iq/ircconnection"
 	"github.com/msparks/iq/notify"
 	"github.com/sorcix/irc"
@@ -25,6 +24,51 @@ type IRCSettings struct {
 	Nicknames []string
 	User string
 	Realname string
+
+	// IRCv3 capabilities to request, e.g. "server-time". Those the server
+	// does not offer are skipped.
+	Capabilities []string
+
+	// SASL mechanism, SASLPlain or SASLExternal. Empty disables SASL.
+	SASLMechanism string
+
+	// Account name. Optional for SASLExternal.
+	SASLAccount string
+
+	// Password for SASLPlain.
+	SASLPassword string
+
+	// Register without logging in if SASL fails, instead of disconnecting and
+	// trying again later.
+	SASLOptional bool
+
+	// Watch for Nicknames[0] to become free while using another nick, and
+	// switch back to it. MONITOR is used if the server supports it and
+	// has room on our list; otherwise ISON is polled every ReclaimInterval
+	// (default one minute).
+	ReclaimNick     bool
+	ReclaimInterval time.Duration
+
+	// While reclaiming, ask NickServ to REGAIN the nick if it is in use. We
+	// must be logged in to the account that owns it.
+	NickServRegain bool
+
+	// Channels to join after registering. Channels we fail to join because
+	// they are full, invite-only, banned or keyed are retried every
+	// JoinRetryInterval (default one minute).
+	Channels          []AutoJoinChannel
+	JoinRetryInterval time.Duration
+
+	// How to reconnect after losing the connection. DefaultBackoff is used
+	// if unset.
+	Reconnect Backoff
+
+	// Reply to CTCP VERSION queries. DefaultCTCPVersion is used if empty.
+	CTCPVersion string
+
+	// CTCP queries are answered at most once per sender every
+	// CTCPInterval (default two seconds). Others are ignored.
+	CTCPInterval time.Duration
 }
 
 type IRCSession struct {
@@ -37,6 +81,71 @@ type IRCSession struct {
 
 	state State
 	mu sync.Mutex
+
+	// Capabilities advertised by the server, with their values, and those it
+	// has acknowledged. Guarded by mu.
+	availableCaps map[string]string
+	enabledCaps   map[string]bool
+
+	// Services account from RPL_LOGGEDIN. Guarded by mu.
+	account string
+
+	// Our nickname. Guarded by mu.
+	nick string
+
+	// What the server supports. Guarded by mu.
+	isupport ISupport
+
+	// Channels we are in, keyed by casefolded name, and those whose NAMES
+	// list is being received. Guarded by mu.
+	channels     map[string]*Channel
+	namesPending map[string]bool
+
+	// Channel lists being received. Guarded by mu.
+	listsPending map[listKey][]ListEntry
+
+	// Users who share a channel with us, keyed by casefolded nick. Guarded
+	// by mu.
+	users map[string]*userState
+
+	// The fields below are only used by the run goroutine.
+
+	// True while capability negotiation is holding up registration.
+	negotiating bool
+
+	// Number of CAP REQs not yet answered with ACK or NAK.
+	capPending int
+
+	// True while a SASL exchange is in progress.
+	authenticating bool
+
+	// Number of nicknames tried during registration.
+	nickAttempt int
+
+	// Length the server truncated a rejected nick to during registration,
+	// or 0. See maxNickLength.
+	truncatedNickLength int
+
+	// Nick reclaim state. reclaimTicker is only set when polling with ISON.
+	reclaiming    bool
+	reclaimTicker *time.Ticker
+	regainSent    bool
+
+	// Configured channels waiting to be retried, keyed by casefolded name.
+	failedJoins    map[string]AutoJoinChannel
+	joinRetryTimer *time.Timer
+
+	// When we last answered a CTCP query from each sender, keyed by
+	// casefolded nick.
+	ctcpReplied map[string]time.Time
+
+	// Why we disconnected, if we asked the connection to because of an
+	// error. The connection then reports no error of its own.
+	disconnectErr error
+
+	// Consecutive reconnect attempts since we last registered.
+	reconnectAttempts int
+	reconnectTimer    *time.Timer
 }
 
 func NewIRCSession(settings IRCSettings, conn *ircconnection.IRCConnection) *IRCSession {
@@ -45,8 +154,16 @@ func NewIRCSession(settings IRCSettings, conn *ircconnection.IRCConnection) *IRC
 		Conn: conn,
 		settings: settings,
 		state: DISCONNECTED,
+		isupport: DefaultISupport(),
+		channels: make(map[string]*Channel),
+		namesPending: make(map[string]bool),
+		listsPending: make(map[listKey][]ListEntry),
+		users: make(map[string]*userState),
+		ctcpReplied: make(map[string]time.Time),
 	}
-	go s.run()
+	// Subscribe before returning so that no connection notifications are
+	// missed.
+	go s.run(conn.NewNotifiee())
 	return s
 }
 
@@ -56,79 +173,175 @@ func (s *IRCSession) State() State {
 	return s.state
 }
 
-func (s *IRCSession) run() {
-	notifiee := s.Conn.NewNotifiee()
+func (s *IRCSession) setState(state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+// Sends a message on the connection, logging failures.
+func (s *IRCSession) send(msg *ircproto.Message) {
+	if err := s.Conn.OutgoingMessageIs(msg); err != nil {
+		log.Printf("Error sending message: %s", err)
+	}
+}
+
+func (s *IRCSession) run(notifiee notify.Notifiee) {
 	defer s.Conn.CloseNotifiee(notifiee)
 
 	for {
-		v := <-notifiee
-
-		switch v := v.(type) {
-		case ircconnection.StateChangeNotification:
-			switch s.Conn.State() {
-			case ircconnection.DISCONNECTED:
-				s.onSocketDisconnect()
-			case ircconnection.CONNECTED:
-				s.onSocketConnect()
-			}
-
-		case ircconnection.IncomingMessageNotification:
-			switch v.Message.GetType() {
-			case ircproto.Message_PING:
-				s.onPing(v.Message)
-
-			case ircproto.Message_REPLY:
-				r := v.Message.GetReply()
-				if r.GetNumeric() == irc.RPL_WELCOME {
-					s.onWelcome(r)
-				}
-			}
+		// Timers are only set while they have work to do.
+		var reclaimTick, joinRetry, reconnect <-chan time.Time
+		if s.reclaimTicker != nil {
+			reclaimTick = s.reclaimTicker.C
+		}
+		if s.joinRetryTimer != nil {
+			joinRetry = s.joinRetryTimer.C
+		}
+		if s.reconnectTimer != nil {
+			reconnect = s.reconnectTimer.C
+		}
+
+		select {
+		case v := <-notifiee:
+			s.handleNotification(v)
+		case <-reclaimTick:
+			s.checkNick()
+		case <-joinRetry:
+			s.retryJoins()
+		case <-reconnect:
+			s.reconnect()
 		}
 	}
 }
 
-func (s *IRCSession) onSocketConnect() {
-	s.state = HANDSHAKING
-	nick := &ircproto.Message{
-		Type: ircproto.Message_NICK.Enum(),
-	Nick: &ircproto.Nick{
-			NewNick: proto.String(s.settings.Nicknames[0]),
-		},
+// Handles a notification from the connection.
+func (s *IRCSession) handleNotification(v interface{}) {
+	switch v := v.(type) {
+	case ircconnection.StateChangeNotification:
+		// Use the state in the notification. The connection may be
+		// delivering another, so calling back into it could block.
+		switch v.State {
+		case ircconnection.DISCONNECTED:
+			s.onSocketDisconnect(v.Err)
+		case ircconnection.CONNECTED:
+			s.onSocketConnect()
+		}
+
+	case ircconnection.PeerCertificateNotification:
+		log.Printf("Server certificate fingerprint for %s: %s",
+			v.Endpoint.Address, v.Fingerprint)
+		if v.ClientFingerprint != "" {
+			log.Printf("Client certificate fingerprint: %s", v.ClientFingerprint)
+		}
+
+	case ircconnection.IncomingMessageNotification:
+		s.onChannelMessage(v.Message, v.Time)
+		s.onUserMessage(v.Message)
+
+		switch v.Message.GetPayload().(type) {
+		case *ircproto.Message_Ping:
+			s.onPing(v.Message)
+
+		case *ircproto.Message_Nick:
+			s.onNick(v.Message.GetNick())
+
+		case *ircproto.Message_Cap:
+			s.onCap(v.Message.GetCap())
+
+		case *ircproto.Message_Authenticate:
+			s.onAuthenticate(v.Message.GetAuthenticate())
+
+		case *ircproto.Message_Ctcp:
+			s.onCtcp(v.Message.GetCtcp())
+
+		case *ircproto.Message_Reply:
+			s.onReply(v.Message.GetReply())
+		}
 	}
+}
+
+func (s *IRCSession) onSocketConnect() {
+	s.setState(HANDSHAKING)
+	s.resetISupport()
+	s.startCapNegotiation()
+	s.nickAttempt = 0
+	s.truncatedNickLength = 0
+	s.tryNextNick()
 	user := &ircproto.Message{
-		Type: ircproto.Message_USER.Enum(),
-	User: &ircproto.User{
-			User: proto.String(s.settings.User),
-			Realname: proto.String(s.settings.Realname),
-		},
+		Payload: &ircproto.Message_User{User: &ircproto.User{
+			User: s.settings.User,
+			Realname: s.settings.Realname,
+		}},
+	}
+	s.send(user)
+}
+
+func (s *IRCSession) onSocketDisconnect(err error) {
+	s.setState(DISCONNECTED)
+	s.clearChannels()
+	s.clearUsers()
+	s.stopReclaim()
+	s.stopJoinRetry()
+	if err == nil {
+		err = s.disconnectErr
 	}
-	s.Conn.OutgoingMessageIs(nick)
-	s.Conn.OutgoingMessageIs(user)
+	s.disconnectErr = nil
+	if err == nil {
+		// The connection was shut down deliberately.
+		log.Printf("Disconnected.")
+		return
+	}
+	s.scheduleReconnect()
 }
 
-func (s *IRCSession) onSocketDisconnect() {
-	s.state = DISCONNECTED
-	time.Sleep(5 * time.Second)
-	log.Printf("Reconnecting...")
-	s.state = CONNECTING
-	go s.Conn.StateIs(ircconnection.CONNECTING)
+func (s *IRCSession) onReply(r *ircproto.Reply) {
+	switch r.GetNumeric() {
+	case irc.RPL_WELCOME:
+		s.onWelcome(r)
+
+	case ircconnection.RPL_LOGGEDIN, ircconnection.RPL_LOGGEDOUT, ircconnection.ERR_NICKLOCKED, ircconnection.RPL_SASLSUCCESS, ircconnection.ERR_SASLFAIL,
+		ircconnection.ERR_SASLTOOLONG, ircconnection.ERR_SASLABORTED, ircconnection.ERR_SASLALREADY, ircconnection.RPL_SASLMECHS:
+		s.onSASLReply(r)
+
+	case ircconnection.RPL_ISUPPORT:
+		s.onISupport(r.GetIsupport())
+
+	case irc.RPL_ENDOFMOTD, ircconnection.ERR_NOMOTD, irc.RPL_ISON, ircconnection.RPL_MONONLINE,
+		ircconnection.RPL_MONOFFLINE, ircconnection.ERR_MONLISTFULL:
+		s.onReclaimReply(r)
+
+	default:
+		if isNickError(r.GetNumeric()) {
+			s.onNickError(r)
+		} else if isJoinError(r.GetNumeric()) {
+			s.onJoinError(r)
+		}
+	}
 }
 
 func (s *IRCSession) onWelcome(m *ircproto.Reply) {
+	// Registration is complete, so the server is not waiting for CAP END.
+	s.negotiating = false
+	s.authenticating = false
+
 	params := m.GetParams()
 	if len(params) > 0 {
-		s.state = CONNECTED
+		// The server tells us which nick we ended up with.
+		s.setNick(params[0])
+		s.setState(CONNECTED)
+		s.reconnectAttempts = 0
 		log.Printf("Connected. Nick is %s", params[0])
+		s.autoJoin()
 	}
 }
 
 func (s *IRCSession) onPing(msg *ircproto.Message) {
 	target := msg.GetPing().GetTarget()
 	reply := &ircproto.Message{
-		Type: ircproto.Message_PONG.Enum(),
-		Pong: &ircproto.Pong{
-			Target: proto.String(target),
-		},
+		Payload: &ircproto.Message_Pong{Pong: &ircproto.Pong{
+			Target: target,
+		}},
 	}
-	s.Conn.OutgoingMessageIs(reply)
+	s.send(reply)
 }
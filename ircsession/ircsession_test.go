@@ -0,0 +1,173 @@
+package ircsession
+
+import (
+	"bufio"
+	"github.com/msparks/iq/ircconnection"
+	"github.com/msparks/iq/notify"
+	. "gopkg.in/check.v1"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type IRCSessionTest struct{}
+
+var _ = Suite(&IRCSessionTest{})
+
+// A fake IRC server with a connected session.
+type fakeServer struct {
+	c        *C
+	session  *IRCSession
+	listener net.Listener
+	peer     net.Conn
+	reader   *bufio.Reader
+
+	// Session notifications, buffered so that the session never blocks on
+	// the test.
+	notifiee      notify.Notifiee
+	notifications chan interface{}
+}
+
+// Starts a session with the given settings connected to a fake server.
+func newFakeServer(c *C, settings IRCSettings) *fakeServer {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	c.Assert(err, IsNil)
+
+	endpoint := ircconnection.Endpoint{Address: listener.Addr().String()}
+	conn := ircconnection.NewIRCConnection([]ircconnection.Endpoint{endpoint})
+	// Don't pace messages.
+	conn.FloodControl = ircconnection.FloodControl{}
+	f := &fakeServer{
+		c:             c,
+		session:       NewIRCSession(settings, conn),
+		listener:      listener,
+		notifications: make(chan interface{}, 100),
+	}
+	f.notifiee = f.session.NewNotifiee()
+	go func() {
+		for v := range f.notifiee {
+			f.notifications <- v
+		}
+	}()
+	go conn.StateIs(ircconnection.CONNECTING)
+	f.Accept()
+	return f
+}
+
+// Accepts a connection from the session.
+func (f *fakeServer) Accept() {
+	peer, err := f.listener.Accept()
+	f.c.Assert(err, IsNil)
+	f.peer = peer
+	f.reader = bufio.NewReader(peer)
+}
+
+// Shuts down the session's connection.
+func (f *fakeServer) Close() {
+	f.listener.Close()
+	f.session.Conn.StateIs(ircconnection.DISCONNECTED)
+	f.peer.Close()
+	f.session.CloseNotifiee(f.notifiee)
+}
+
+// Returns the next session notification of the same type as want, skipping
+// others.
+func (f *fakeServer) Notification(want interface{}) interface{} {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case v := <-f.notifications:
+			if reflect.TypeOf(v) == reflect.TypeOf(want) {
+				return v
+			}
+		case <-timeout:
+			f.c.Fatalf("Timed out waiting for %T", want)
+		}
+	}
+}
+
+// Sends a line to the session.
+func (f *fakeServer) Send(line string) {
+	_, err := io.WriteString(f.peer, line+"\r\n")
+	f.c.Assert(err, IsNil)
+}
+
+// Reads the next line from the session.
+func (f *fakeServer) Next() string {
+	f.peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := f.reader.ReadString('\n')
+	f.c.Assert(err, IsNil)
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Checks that the next line from the session is line.
+func (f *fakeServer) Expect(line string) {
+	f.c.Check(f.Next(), Equals, line)
+}
+
+// Waits up to two seconds for cond to become true.
+func waitFor(c *C, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Settings for sessions under test. Tests copy these and set the fields
+// they exercise. Settings that only matter once a feature is turned on are
+// filled in here so that tests need not repeat them.
+var testSettings = IRCSettings{
+	Nicknames: []string{"iq"},
+	User:      "iq",
+	Realname:  "IQ",
+
+	SASLAccount:       "account",
+	SASLPassword:      "secret",
+	ReclaimInterval:   10 * time.Millisecond,
+	JoinRetryInterval: 10 * time.Millisecond,
+}
+
+// Completes registration as iq.
+func register(f *fakeServer) {
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test 001 iq :Welcome")
+}
+
+// Checks that the server side of the connection is closed.
+func expectClosed(c *C, f *fakeServer) {
+	f.peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := f.reader.ReadString('\n')
+	c.Check(err, Equals, io.EOF)
+}
+
+func (s *IRCSessionTest) TestRegister(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+
+	// No capabilities wanted, so no CAP LS.
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	waitFor(c, func() bool { return f.session.State() == HANDSHAKING })
+
+	f.Send(":irc.test 001 iq :Welcome")
+	waitFor(c, func() bool { return f.session.State() == CONNECTED })
+}
+
+func (s *IRCSessionTest) TestPing(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+
+	f.Send("PING :irc.test")
+	f.Expect("PONG :irc.test")
+}
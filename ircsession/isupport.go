@@ -0,0 +1,227 @@
+package ircsession
+
+import (
+	ircproto "github.com/msparks/iq/public/irc"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Case mappings, which say which nicks and channel names are equal.
+const (
+	CaseMappingRFC1459       = "rfc1459"
+	CaseMappingStrictRFC1459 = "strict-rfc1459"
+	CaseMappingASCII         = "ascii"
+)
+
+// Features of the network, from RPL_ISUPPORT (005). Fields the server does
+// not advertise have their RFC 1459 defaults.
+type ISupport struct {
+	// One of the CaseMapping constants. Unknown mappings are treated as
+	// CaseMappingRFC1459.
+	CaseMapping string
+
+	// Characters that start a channel name, e.g. "#&".
+	ChanTypes string
+
+	// Channel membership modes, highest first, and the nick prefixes that
+	// show them in NAMES and WHO, e.g. "ov" and "@+".
+	PrefixModes   string
+	PrefixSymbols string
+
+	// Channel modes by type: A modes are lists and always take a
+	// parameter, B modes always take one, C modes take one only when set,
+	// and D modes never do.
+	ChanModes [4]string
+
+	// Maximum nick length, or 0 if not advertised.
+	NickLen int
+
+	// Maximum number of targets per command, keyed by command. 0 means
+	// no limit. Commands not listed are not limited by TARGMAX.
+	TargMax map[string]int
+
+	// Maximum line length in bytes, including the CRLF.
+	LineLen int
+
+	// Whether the server supports MONITOR.
+	Monitor bool
+
+	// All parameters as advertised, with escapes decoded. Parameters
+	// without a value map to "".
+	Params map[string]string
+}
+
+// Delivered to notifiees when RPL_ISUPPORT changes what we know about the
+// network.
+type ISupportNotification struct {
+	ISupport ISupport
+}
+
+// Returns what the server supports, as far as we know. The defaults apply
+// until the server sends RPL_ISUPPORT.
+func (s *IRCSession) ISupport() ISupport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isupport.copy()
+}
+
+// Returns an ISupport with only the defaults.
+func DefaultISupport() ISupport {
+	return newISupport(nil)
+}
+
+// Returns the ISupport described by params, filling in defaults.
+func newISupport(params map[string]string) ISupport {
+	i := ISupport{
+		CaseMapping:   CaseMappingRFC1459,
+		ChanTypes:     "#&",
+		PrefixModes:   "ov",
+		PrefixSymbols: "@+",
+		ChanModes:     [4]string{"beI", "k", "l", "imnpst"},
+		LineLen:       512,
+		Params:        params,
+	}
+	if v, ok := params["CASEMAPPING"]; ok {
+		i.CaseMapping = strings.ToLower(v)
+	}
+	if v, ok := params["CHANTYPES"]; ok {
+		i.ChanTypes = v
+	}
+	if v, ok := params["PREFIX"]; ok {
+		// (modes)symbols, or empty if there are none.
+		i.PrefixModes, i.PrefixSymbols = "", ""
+		if end := strings.IndexByte(v, ')'); strings.HasPrefix(v, "(") && end > 0 {
+			modes, symbols := v[1:end], v[end+1:]
+			if len(modes) == len(symbols) {
+				i.PrefixModes, i.PrefixSymbols = modes, symbols
+			}
+		}
+	}
+	if v, ok := params["CHANMODES"]; ok {
+		// Later types may be added, which we don't know how to handle.
+		i.ChanModes = [4]string{}
+		copy(i.ChanModes[:], strings.Split(v, ","))
+	}
+	if v, ok := params["NICKLEN"]; ok {
+		i.NickLen, _ = strconv.Atoi(v)
+	}
+	if v, ok := params["TARGMAX"]; ok {
+		i.TargMax = make(map[string]int)
+		for _, target := range strings.Split(v, ",") {
+			command, max := target, ""
+			if n := strings.IndexByte(target, ':'); n >= 0 {
+				command, max = target[:n], target[n+1:]
+			}
+			if command == "" {
+				continue
+			}
+			i.TargMax[strings.ToUpper(command)], _ = strconv.Atoi(max)
+		}
+	}
+	if v, ok := params["LINELEN"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			i.LineLen = n
+		}
+	}
+	_, i.Monitor = params["MONITOR"]
+	return i
+}
+
+func (i ISupport) copy() ISupport {
+	if i.TargMax != nil {
+		targMax := make(map[string]int, len(i.TargMax))
+		for k, v := range i.TargMax {
+			targMax[k] = v
+		}
+		i.TargMax = targMax
+	}
+	if i.Params != nil {
+		i.Params = copyParams(i.Params)
+	}
+	return i
+}
+
+func copyParams(params map[string]string) map[string]string {
+	c := make(map[string]string, len(params))
+	for k, v := range params {
+		c[k] = v
+	}
+	return c
+}
+
+// Returns the maximum number of targets for command, or 0 for no limit.
+func (i ISupport) MaxTargets(command string) int {
+	return i.TargMax[strings.ToUpper(command)]
+}
+
+// Returns the longest line we may send, excluding the CRLF.
+func (i ISupport) MaxLineLength() int {
+	return i.LineLen - 2
+}
+
+// Returns whether name is a channel name rather than a nick.
+func (i ISupport) IsChannel(name string) bool {
+	return name != "" && strings.IndexByte(i.ChanTypes, name[0]) >= 0
+}
+
+// Returns name in lower case according to the case mapping. Names that
+// fold to the same string are equal.
+func (i ISupport) Fold(name string) string {
+	// The upper case forms of "{", "}", "|" and "~" under RFC 1459.
+	upper := "[]\\^"
+	switch i.CaseMapping {
+	case CaseMappingASCII:
+		upper = ""
+	case CaseMappingStrictRFC1459:
+		upper = "[]\\"
+	}
+	b := []byte(name)
+	for n, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[n] = c + 'a' - 'A'
+		} else if strings.IndexByte(upper, c) >= 0 {
+			// "[" is 0x5b and "{" is 0x7b, and so on.
+			b[n] = c + 0x20
+		}
+	}
+	return string(b)
+}
+
+// Returns whether two nicks or channel names are equal under the case
+// mapping.
+func (i ISupport) Equal(a, b string) bool {
+	return i.Fold(a) == i.Fold(b)
+}
+
+// Returns whether two nicks or channel names are equal on this network.
+func (s *IRCSession) nameEqual(a, b string) bool {
+	return s.ISupport().Equal(a, b)
+}
+
+// Updates what we know from an RPL_ISUPPORT reply.
+func (s *IRCSession) onISupport(r *ircproto.ISupport) {
+	s.mu.Lock()
+	params := copyParams(s.isupport.Params)
+	for name, value := range r.GetParams() {
+		params[name] = value
+	}
+	for _, name := range r.GetRemoved() {
+		delete(params, name)
+	}
+	isupport := newISupport(params)
+	changed := !reflect.DeepEqual(isupport, s.isupport)
+	s.isupport = isupport
+	s.mu.Unlock()
+
+	if changed {
+		s.Notify(ISupportNotification{ISupport: isupport.copy()})
+	}
+}
+
+// Forgets what the previous server supported.
+func (s *IRCSession) resetISupport() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isupport = DefaultISupport()
+}
@@ -0,0 +1,108 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type ISupportTest struct{}
+
+var _ = Suite(&ISupportTest{})
+
+func (s *ISupportTest) TestDefaults(c *C) {
+	i := DefaultISupport()
+	c.Check(i.CaseMapping, Equals, CaseMappingRFC1459)
+	c.Check(i.ChanTypes, Equals, "#&")
+	c.Check(i.PrefixModes, Equals, "ov")
+	c.Check(i.PrefixSymbols, Equals, "@+")
+	c.Check(i.MaxLineLength(), Equals, 510)
+	c.Check(i.MaxTargets("PRIVMSG"), Equals, 0)
+	c.Check(i.Monitor, Equals, false)
+}
+
+func (s *ISupportTest) TestParse(c *C) {
+	i := newISupport(map[string]string{
+		"CASEMAPPING": "ascii",
+		"CHANTYPES":   "#",
+		"PREFIX":      "(qaohv)~&@%+",
+		"CHANMODES":   "beI,k,l,imnpst,X",
+		"NICKLEN":     "30",
+		"TARGMAX":     "PRIVMSG:4,WHOIS:1,JOIN:",
+		"LINELEN":     "2048",
+		"MONITOR":     "100",
+	})
+	c.Check(i.CaseMapping, Equals, CaseMappingASCII)
+	c.Check(i.ChanTypes, Equals, "#")
+	c.Check(i.PrefixModes, Equals, "qaohv")
+	c.Check(i.PrefixSymbols, Equals, "~&@%+")
+	c.Check(i.ChanModes, Equals, [4]string{"beI", "k", "l", "imnpst"})
+	c.Check(i.NickLen, Equals, 30)
+	c.Check(i.TargMax, DeepEquals, map[string]int{
+		"PRIVMSG": 4, "WHOIS": 1, "JOIN": 0})
+	c.Check(i.MaxTargets("privmsg"), Equals, 4)
+	c.Check(i.MaxLineLength(), Equals, 2046)
+	c.Check(i.Monitor, Equals, true)
+
+	// No prefixes at all.
+	i = newISupport(map[string]string{"PREFIX": ""})
+	c.Check(i.PrefixModes, Equals, "")
+	c.Check(i.PrefixSymbols, Equals, "")
+}
+
+func (s *ISupportTest) TestFold(c *C) {
+	rfc1459 := DefaultISupport()
+	c.Check(rfc1459.Fold("Nick[]\\^"), Equals, "nick{}|~")
+	c.Check(rfc1459.Equal("IQ[away]", "iq{AWAY}"), Equals, true)
+
+	strict := newISupport(map[string]string{"CASEMAPPING": "strict-rfc1459"})
+	c.Check(strict.Fold("Nick[]\\^"), Equals, "nick{}|^")
+
+	ascii := newISupport(map[string]string{"CASEMAPPING": "ascii"})
+	c.Check(ascii.Fold("Nick[]"), Equals, "nick[]")
+	c.Check(ascii.Equal("iq[", "iq{"), Equals, false)
+}
+
+func (s *ISupportTest) TestIsChannel(c *C) {
+	i := DefaultISupport()
+	c.Check(i.IsChannel("#iq"), Equals, true)
+	c.Check(i.IsChannel("&local"), Equals, true)
+	c.Check(i.IsChannel("iq"), Equals, false)
+	c.Check(i.IsChannel(""), Equals, false)
+}
+
+func (s *ISupportTest) TestSession(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	register(f)
+
+	f.Send(":irc.test 005 iq CASEMAPPING=ascii NICKLEN=30 :are supported by this server")
+	v := f.Notification(ISupportNotification{}).(ISupportNotification)
+	c.Check(v.ISupport.CaseMapping, Equals, CaseMappingASCII)
+	c.Check(v.ISupport.NickLen, Equals, 30)
+
+	// Later replies add to the earlier ones, and may remove parameters.
+	f.Send(":irc.test 005 iq CHANTYPES=# -NICKLEN :are supported by this server")
+	v = f.Notification(ISupportNotification{}).(ISupportNotification)
+	c.Check(v.ISupport.CaseMapping, Equals, CaseMappingASCII)
+	c.Check(v.ISupport.ChanTypes, Equals, "#")
+	c.Check(v.ISupport.NickLen, Equals, 0)
+	c.Check(f.session.ISupport().Params, DeepEquals, map[string]string{
+		"CASEMAPPING": "ascii", "CHANTYPES": "#"})
+}
+
+func (s *ISupportTest) TestNickCaseMapping(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iq[1]"}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	f.Expect("NICK iq[1]")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test 001 iq[1] :Welcome")
+
+	// Under RFC 1459, "{" is the lower case of "[".
+	f.Send(":IQ{1}!iq@host NICK iq2")
+	v := f.Notification(NickChangeNotification{}).(NickChangeNotification)
+	for v.Nick != "iq2" {
+		v = f.Notification(NickChangeNotification{}).(NickChangeNotification)
+	}
+	c.Check(f.session.Nick(), Equals, "iq2")
+}
@@ -0,0 +1,150 @@
+package ircsession
+
+import (
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"log"
+	"strings"
+	"time"
+)
+
+// Default delay before retrying channels we could not join.
+const defaultJoinRetryInterval = time.Minute
+
+// A channel to join after connecting.
+type AutoJoinChannel struct {
+	Name string
+
+	// Channel key (mode +k), if any.
+	Key string
+}
+
+// Returns JOIN messages for the channels, batched so that each fits on one
+// line and within the server's target limit. Keyed channels are listed
+// first, since keys are matched to channels by position.
+func joinMessages(channels []AutoJoinChannel, isupport ISupport) []*ircproto.Message {
+	maxLength := isupport.MaxLineLength()
+	maxTargets := isupport.MaxTargets(irc.JOIN)
+
+	var keyed, unkeyed []AutoJoinChannel
+	for _, ch := range channels {
+		if ch.Key != "" {
+			keyed = append(keyed, ch)
+		} else {
+			unkeyed = append(unkeyed, ch)
+		}
+	}
+
+	var msgs []*ircproto.Message
+	var join *ircproto.Join
+	length := 0
+	for _, ch := range append(keyed, unkeyed...) {
+		// Room for a separating comma before the name and the key.
+		add := len(ch.Name) + 1
+		if ch.Key != "" {
+			add += len(ch.Key) + 1
+		}
+		if join != nil && (length+add > maxLength ||
+			maxTargets > 0 && len(join.Channels) >= maxTargets) {
+			join = nil
+		}
+		if join == nil {
+			join = &ircproto.Join{}
+			msgs = append(msgs, &ircproto.Message{
+				Payload: &ircproto.Message_Join{Join: join},
+			})
+			// "JOIN" plus the separating spaces.
+			length = len(irc.JOIN) + 2
+		}
+		join.Channels = append(join.Channels, ch.Name)
+		if ch.Key != "" {
+			join.Keys = append(join.Keys, ch.Key)
+		}
+		length += add
+	}
+	return msgs
+}
+
+// Joins the channels.
+func (s *IRCSession) join(channels []AutoJoinChannel) {
+	var names []string
+	for _, ch := range channels {
+		names = append(names, ch.Name)
+	}
+	log.Printf("Joining %s", strings.Join(names, " "))
+
+	for _, msg := range joinMessages(channels, s.ISupport()) {
+		s.send(msg)
+	}
+}
+
+// Joins the configured channels. Called once registration is complete.
+func (s *IRCSession) autoJoin() {
+	s.failedJoins = nil
+	s.stopJoinRetry()
+	if len(s.settings.Channels) > 0 {
+		s.join(s.settings.Channels)
+	}
+}
+
+// Handles a failure to join a channel. Configured channels are retried
+// later, since bans, limits and invite-only modes are often temporary.
+func (s *IRCSession) onJoinError(r *ircproto.Reply) {
+	// <client> <channel> :<reason>
+	params := r.GetParams()
+	if len(params) < 2 {
+		return
+	}
+	name := params[1]
+	log.Printf("Cannot join %s: %s", name, r.GetTrailing())
+
+	isupport := s.ISupport()
+	for _, ch := range s.settings.Channels {
+		if !isupport.Equal(ch.Name, name) {
+			continue
+		}
+		if s.failedJoins == nil {
+			s.failedJoins = make(map[string]AutoJoinChannel)
+		}
+		s.failedJoins[isupport.Fold(ch.Name)] = ch
+		if s.joinRetryTimer == nil {
+			interval := s.settings.JoinRetryInterval
+			if interval <= 0 {
+				interval = defaultJoinRetryInterval
+			}
+			s.joinRetryTimer = time.NewTimer(interval)
+		}
+	}
+}
+
+// Tries again to join the channels that failed.
+func (s *IRCSession) retryJoins() {
+	s.joinRetryTimer = nil
+	if len(s.failedJoins) == 0 || s.State() != CONNECTED {
+		return
+	}
+	var channels []AutoJoinChannel
+	for _, ch := range s.failedJoins {
+		channels = append(channels, ch)
+	}
+	s.failedJoins = nil
+	s.join(channels)
+}
+
+func (s *IRCSession) stopJoinRetry() {
+	if s.joinRetryTimer != nil {
+		s.joinRetryTimer.Stop()
+		s.joinRetryTimer = nil
+	}
+}
+
+// Returns whether a numeric reports a failure to join a channel that may
+// succeed later.
+func isJoinError(numeric string) bool {
+	switch numeric {
+	case irc.ERR_CHANNELISFULL, irc.ERR_INVITEONLYCHAN, irc.ERR_BANNEDFROMCHAN,
+		irc.ERR_BADCHANNELKEY:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package ircsession
+
+import (
+	"fmt"
+	. "gopkg.in/check.v1"
+	"strings"
+	"time"
+)
+
+type JoinTest struct{}
+
+var _ = Suite(&JoinTest{})
+
+func (s *JoinTest) TestJoinOnWelcome(c *C) {
+	settings := testSettings
+	settings.Channels = []AutoJoinChannel{
+		{Name: "#iq"},
+		{Name: "#secret", Key: "hunter2"},
+		{Name: "#go"},
+	}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	register(f)
+
+	// Keyed channels come first.
+	f.Expect("JOIN #secret,#iq,#go hunter2")
+}
+
+func (s *JoinTest) TestNoChannels(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	register(f)
+
+	f.Send("PING :sync")
+	f.Expect("PONG :sync")
+}
+
+func (s *JoinTest) TestBatching(c *C) {
+	var channels []AutoJoinChannel
+	for i := 0; i < 100; i++ {
+		channels = append(channels, AutoJoinChannel{
+			Name: fmt.Sprintf("#channel-with-a-long-name-%03d", i),
+		})
+	}
+
+	msgs := joinMessages(channels, DefaultISupport())
+	c.Assert(len(msgs) > 1, Equals, true)
+	var joined []string
+	for _, msg := range msgs {
+		names := strings.Join(msg.GetJoin().GetChannels(), ",")
+		c.Check(len("JOIN "+names) <= 510, Equals, true)
+		joined = append(joined, msg.GetJoin().GetChannels()...)
+	}
+	c.Check(len(joined), Equals, len(channels))
+	c.Check(joined[0], Equals, channels[0].Name)
+	c.Check(joined[99], Equals, channels[99].Name)
+}
+
+func (s *JoinTest) TestBatchingKeys(c *C) {
+	var channels []AutoJoinChannel
+	for i := 0; i < 40; i++ {
+		channels = append(channels, AutoJoinChannel{
+			Name: fmt.Sprintf("#chan%02d", i),
+			Key:  strings.Repeat("k", 20),
+		})
+	}
+
+	msgs := joinMessages(channels, DefaultISupport())
+	c.Assert(len(msgs) > 1, Equals, true)
+	for _, msg := range msgs {
+		join := msg.GetJoin()
+		c.Check(len(join.GetKeys()), Equals, len(join.GetChannels()))
+		line := "JOIN " + strings.Join(join.GetChannels(), ",") + " " +
+			strings.Join(join.GetKeys(), ",")
+		c.Check(len(line) <= 510, Equals, true)
+	}
+}
+
+func (s *JoinTest) TestRetry(c *C) {
+	settings := testSettings
+	settings.Channels = []AutoJoinChannel{
+		{Name: "#iq"},
+		{Name: "#locked", Key: "wrong"},
+	}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	register(f)
+	f.Expect("JOIN #locked,#iq wrong")
+
+	f.Send(":irc.test 475 iq #locked :Cannot join channel (+k)")
+	f.Expect("JOIN #locked wrong")
+	f.Send(":irc.test 474 iq #LOCKED :Cannot join channel (+b)")
+	f.Expect("JOIN #locked wrong")
+}
+
+func (s *JoinTest) TestUnconfiguredChannelNotRetried(c *C) {
+	settings := testSettings
+	settings.Channels = []AutoJoinChannel{{Name: "#iq"}}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	register(f)
+	f.Expect("JOIN #iq")
+
+	f.Send(":irc.test 473 iq #other :Cannot join channel (+i)")
+	time.Sleep(50 * time.Millisecond)
+	f.Send("PING :sync")
+	f.Expect("PONG :sync")
+}
+
+func (s *JoinTest) TestBatchingTargMax(c *C) {
+	var channels []AutoJoinChannel
+	for i := 0; i < 5; i++ {
+		channels = append(channels, AutoJoinChannel{Name: fmt.Sprintf("#c%d", i)})
+	}
+	isupport := newISupport(map[string]string{"TARGMAX": "JOIN:2,PRIVMSG:4"})
+
+	msgs := joinMessages(channels, isupport)
+	c.Assert(len(msgs), Equals, 3)
+	c.Check(msgs[0].GetJoin().GetChannels(), DeepEquals, []string{"#c0", "#c1"})
+	c.Check(msgs[2].GetJoin().GetChannels(), DeepEquals, []string{"#c4"})
+}
@@ -0,0 +1,175 @@
+package ircsession
+
+import (
+	"errors"
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"strings"
+	"time"
+)
+
+// An entry of a channel's ban, ban exception or invite exception list.
+type ListEntry struct {
+	Mask string
+
+	// Who set the entry and when. Not all servers send these in list
+	// replies; SetAt is zero if unknown.
+	SetBy string
+	SetAt time.Time
+}
+
+// Delivered to notifiees when a channel list has been received from the
+// server, or when a MODE changes a list we have. Entries is the whole
+// list.
+type ListNotification struct {
+	Channel string
+
+	// The list mode, e.g. "b" for bans.
+	Mode byte
+
+	Entries []ListEntry
+}
+
+// Identifies a list being received.
+type listKey struct {
+	// Casefolded channel name.
+	channel string
+	mode    byte
+}
+
+// Asks the server for a channel list, e.g. bans with mode "b". The list is
+// cached in Channel.Lists and a ListNotification is delivered when it has
+// been received. Returns an error if we are not in the channel or mode is
+// not a list mode on this network.
+func (s *IRCSession) RequestList(channel string, mode byte) error {
+	isupport := s.ISupport()
+	if isupport.ModeType(mode) != ModeTypeList {
+		return errors.New("not a list mode: " + string(mode))
+	}
+	if _, ok := s.Channel(channel); !ok {
+		return errors.New("not in channel " + channel)
+	}
+	s.send(&ircproto.Message{
+		Payload: &ircproto.Message_Mode{Mode: &ircproto.Mode{
+			Target: channel,
+			Modes:  "+" + string(mode),
+		}},
+	})
+	return nil
+}
+
+// Returns the list mode a list numeric is about. Servers that use other
+// letters for exceptions advertise them with EXCEPTS and INVEX.
+func listMode(isupport ISupport, numeric string) byte {
+	switch numeric {
+	case irc.RPL_EXCEPTLIST, irc.RPL_ENDOFEXCEPTLIST:
+		if v := isupport.Params["EXCEPTS"]; v != "" {
+			return v[0]
+		}
+		return 'e'
+	case irc.RPL_INVITELIST, irc.RPL_ENDOFINVITELIST:
+		if v := isupport.Params["INVEX"]; v != "" {
+			return v[0]
+		}
+		return 'I'
+	}
+	return 'b'
+}
+
+// Tracks channel lists from a numeric reply.
+func (s *IRCSession) onListReply(r *ircproto.Reply) {
+	switch r.GetNumeric() {
+	case irc.RPL_BANLIST, irc.RPL_EXCEPTLIST, irc.RPL_INVITELIST:
+		entry := r.GetListEntry()
+		if entry == nil {
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		key := listKey{s.isupport.Fold(entry.GetChannel()), listMode(s.isupport, r.GetNumeric())}
+		if s.channels[key.channel] == nil {
+			return
+		}
+		e := ListEntry{Mask: entry.GetMask(), SetBy: entry.GetSetBy()}
+		if entry.GetSetAt() != 0 {
+			e.SetAt = time.Unix(entry.GetSetAt(), 0)
+		}
+		s.listsPending[key] = append(s.listsPending[key], e)
+
+	case irc.RPL_ENDOFBANLIST, irc.RPL_ENDOFEXCEPTLIST, irc.RPL_ENDOFINVITELIST:
+		end := r.GetEndOfList()
+		if end == nil {
+			return
+		}
+		s.mu.Lock()
+		key := listKey{s.isupport.Fold(end.GetTarget()), listMode(s.isupport, r.GetNumeric())}
+		entries := s.listsPending[key]
+		delete(s.listsPending, key)
+		ch := s.channels[key.channel]
+		if ch == nil {
+			s.mu.Unlock()
+			return
+		}
+		ch.Lists[key.mode] = entries
+		n := ListNotification{Channel: ch.Name, Mode: key.mode, Entries: copyList(entries)}
+		s.mu.Unlock()
+		s.Notify(n)
+	}
+}
+
+// Applies list changes from a MODE to the lists we have. Lists we have not
+// received are left alone, since we don't know the rest of them.
+func (s *IRCSession) onListModes(modes ModeNotification) {
+	s.mu.Lock()
+	ch := s.channels[s.isupport.Fold(modes.Channel)]
+	if ch == nil {
+		s.mu.Unlock()
+		return
+	}
+	// The modes of the lists that changed, once each.
+	var changed string
+	for _, c := range modes.Changes {
+		list, ok := ch.Lists[c.Mode]
+		if c.Type != ModeTypeList || !ok || c.Arg == "" {
+			continue
+		}
+		i := 0
+		for _, e := range list {
+			if !s.isupport.Equal(e.Mask, c.Arg) {
+				list[i] = e
+				i++
+			}
+		}
+		list = list[:i]
+		if c.Add {
+			list = append(list, ListEntry{Mask: c.Arg, SetBy: modes.Source, SetAt: modes.Time})
+		}
+		ch.Lists[c.Mode] = list
+		if strings.IndexByte(changed, c.Mode) < 0 {
+			changed += string(c.Mode)
+		}
+	}
+	var ns []ListNotification
+	for i := 0; i < len(changed); i++ {
+		ns = append(ns, ListNotification{
+			Channel: ch.Name, Mode: changed[i], Entries: copyList(ch.Lists[changed[i]])})
+	}
+	s.mu.Unlock()
+
+	for _, n := range ns {
+		s.Notify(n)
+	}
+}
+
+func copyList(list []ListEntry) []ListEntry {
+	return append([]ListEntry{}, list...)
+}
+
+// Forgets lists being received for a channel. s.mu must be held.
+func (s *IRCSession) clearPendingLists(channel string) {
+	for key := range s.listsPending {
+		if key.channel == channel {
+			delete(s.listsPending, key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type ListsTest struct{}
+
+var _ = Suite(&ListsTest{})
+
+func (s *ListsTest) TestRequest(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+	f.Expect("WHO #iq")
+
+	c.Assert(f.session.RequestList("#IQ", 'b'), IsNil)
+	f.Expect("MODE #IQ +b")
+	f.Send(":irc.test 367 iq #iq *!*@spam alice!a@host 1400000000")
+	f.Send(":irc.test 367 iq #iq *!*@eggs")
+	f.Send(":irc.test 368 iq #iq :End of channel ban list")
+	v := f.Notification(ListNotification{}).(ListNotification)
+	want := []ListEntry{
+		{Mask: "*!*@spam", SetBy: "alice!a@host", SetAt: time.Unix(1400000000, 0)},
+		{Mask: "*!*@eggs"},
+	}
+	c.Check(v.Channel, Equals, "#iq")
+	c.Check(v.Mode, Equals, byte('b'))
+	c.Check(v.Entries, DeepEquals, want)
+
+	ch, _ := f.session.Channel("#iq")
+	c.Check(ch.Lists, DeepEquals, map[byte][]ListEntry{'b': want})
+}
+
+func (s *ListsTest) TestEmptyList(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	// Replies to a MODE query not sent by RequestList are cached too.
+	f.Send(":irc.test 349 iq #iq :End of channel exception list")
+	v := f.Notification(ListNotification{}).(ListNotification)
+	c.Check(v.Mode, Equals, byte('e'))
+	c.Check(v.Entries, HasLen, 0)
+	ch, _ := f.session.Channel("#iq")
+	_, ok := ch.Lists['e']
+	c.Check(ok, Equals, true)
+}
+
+func (s *ListsTest) TestInvalidRequest(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	c.Check(f.session.RequestList("#iq", 'k'), NotNil)
+	c.Check(f.session.RequestList("#other", 'b'), NotNil)
+}
+
+func (s *ListsTest) TestModeUpdates(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	f.Send(":irc.test 367 iq #iq *!*@spam")
+	f.Send(":irc.test 368 iq #iq :End of channel ban list")
+	f.Notification(ListNotification{})
+
+	// Invite exceptions were not fetched, so they are not tracked.
+	when := time.Date(2014, 5, 13, 12, 0, 0, 0, time.UTC)
+	f.Send("@time=2014-05-13T12:00:00.000Z :alice!a@host MODE #iq -b+bI *!*@SPAM *!*@eggs *!*@ham")
+	v := f.Notification(ListNotification{}).(ListNotification)
+	c.Check(v.Mode, Equals, byte('b'))
+	c.Assert(v.Entries, HasLen, 1)
+	c.Check(v.Entries[0].Mask, Equals, "*!*@eggs")
+	c.Check(v.Entries[0].SetBy, Equals, "alice")
+	c.Check(v.Entries[0].SetAt.Equal(when), Equals, true)
+
+	ch, _ := f.session.Channel("#iq")
+	c.Check(ch.Lists, HasLen, 1)
+	c.Check(ch.Lists['b'], HasLen, 1)
+}
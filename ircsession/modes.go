@@ -0,0 +1,116 @@
+package ircsession
+
+import (
+	"strings"
+	"time"
+)
+
+// How a channel mode behaves, from the CHANMODES and PREFIX the server
+// advertises. The values match ModeChange.Type in public/events.proto.
+type ModeType int
+
+const (
+	// Never takes a parameter, e.g. "n" or "m". Modes the server did not
+	// advertise are assumed to be flags.
+	ModeTypeFlag ModeType = iota
+
+	// Gives a member a status such as operator ("o"). The parameter is the
+	// nick.
+	ModeTypeMembership
+
+	// Adds to or removes from a list, such as bans ("b"). The parameter is
+	// a mask. Without one, the list is being asked for.
+	ModeTypeList
+
+	// Always takes a parameter, e.g. the key ("k").
+	ModeTypeParam
+
+	// Takes a parameter only when set, e.g. the user limit ("l").
+	ModeTypeParamWhenSet
+)
+
+// One channel mode being set or unset.
+type ModeChange struct {
+	// True if the mode is being set, false if unset.
+	Add  bool
+	Mode byte
+	Type ModeType
+
+	// The parameter, if the mode takes one. Empty if the server left it
+	// out.
+	Arg string
+}
+
+// Returns the change as it would appear in a MODE line, e.g. "+o alice".
+func (c ModeChange) String() string {
+	s := "-" + string(c.Mode)
+	if c.Add {
+		s = "+" + string(c.Mode)
+	}
+	if c.Arg != "" {
+		s += " " + c.Arg
+	}
+	return s
+}
+
+// Delivered to notifiees when modes change in a channel we are in.
+type ModeNotification struct {
+	Channel string
+
+	// The nick or server that changed the modes.
+	Source string
+
+	Changes []ModeChange
+
+	// When the change happened. See
+	// ircconnection.IncomingMessageNotification.
+	Time time.Time
+}
+
+// Returns how a channel mode behaves on this network.
+func (i ISupport) ModeType(mode byte) ModeType {
+	switch {
+	case strings.IndexByte(i.PrefixModes, mode) >= 0:
+		return ModeTypeMembership
+	case strings.IndexByte(i.ChanModes[0], mode) >= 0:
+		return ModeTypeList
+	case strings.IndexByte(i.ChanModes[1], mode) >= 0:
+		return ModeTypeParam
+	case strings.IndexByte(i.ChanModes[2], mode) >= 0:
+		return ModeTypeParamWhenSet
+	}
+	return ModeTypeFlag
+}
+
+// Splits a channel mode string such as "+ov-b" and its arguments into
+// changes, e.g. "+o nick1", "+v nick2" and "-b mask".
+func (i ISupport) ParseModes(modes string, args []string) []ModeChange {
+	var changes []ModeChange
+	add := true
+	for n := 0; n < len(modes); n++ {
+		switch c := modes[n]; c {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			change := ModeChange{Add: add, Mode: c, Type: i.ModeType(c)}
+			if change.takesArg() && len(args) > 0 {
+				change.Arg = args[0]
+				args = args[1:]
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func (c ModeChange) takesArg() bool {
+	switch c.Type {
+	case ModeTypeMembership, ModeTypeList, ModeTypeParam:
+		return true
+	case ModeTypeParamWhenSet:
+		return c.Add
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type ModesTest struct{}
+
+var _ = Suite(&ModesTest{})
+
+func (s *ModesTest) TestParse(c *C) {
+	i := newISupport(map[string]string{
+		"PREFIX":    "(ov)@+",
+		"CHANMODES": "beI,k,l,imnst",
+	})
+	changes := i.ParseModes("+ov-b+lk-lX", []string{
+		"nick1", "nick2", "*!*@spam", "10", "secret"})
+	c.Check(changes, DeepEquals, []ModeChange{
+		{Add: true, Mode: 'o', Type: ModeTypeMembership, Arg: "nick1"},
+		{Add: true, Mode: 'v', Type: ModeTypeMembership, Arg: "nick2"},
+		{Add: false, Mode: 'b', Type: ModeTypeList, Arg: "*!*@spam"},
+		{Add: true, Mode: 'l', Type: ModeTypeParamWhenSet, Arg: "10"},
+		{Add: true, Mode: 'k', Type: ModeTypeParam, Arg: "secret"},
+		// Unset without a parameter.
+		{Add: false, Mode: 'l', Type: ModeTypeParamWhenSet},
+		// Not advertised.
+		{Add: false, Mode: 'X', Type: ModeTypeFlag},
+	})
+
+	var strs []string
+	for _, change := range changes[:3] {
+		strs = append(strs, change.String())
+	}
+	c.Check(strs, DeepEquals, []string{"+o nick1", "+v nick2", "-b *!*@spam"})
+}
+
+func (s *ModesTest) TestMissingArgs(c *C) {
+	changes := DefaultISupport().ParseModes("+bo", []string{"*!*@spam"})
+	c.Check(changes, DeepEquals, []ModeChange{
+		{Add: true, Mode: 'b', Type: ModeTypeList, Arg: "*!*@spam"},
+		{Add: true, Mode: 'o', Type: ModeTypeMembership},
+	})
+}
+
+func (s *ModesTest) TestNetworkModes(c *C) {
+	// With a different CHANMODES, "q" is a list rather than membership.
+	i := newISupport(map[string]string{
+		"PREFIX":    "(ov)@+",
+		"CHANMODES": "bq,k,l,imnst",
+	})
+	c.Check(i.ModeType('q'), Equals, ModeTypeList)
+	i = newISupport(map[string]string{"PREFIX": "(qov)~@+"})
+	c.Check(i.ModeType('q'), Equals, ModeTypeMembership)
+}
+
+func (s *ModesTest) TestNotification(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	f.Send(":alice!a@host MODE #iq +o-v bob bob")
+	v := f.Notification(ModeNotification{}).(ModeNotification)
+	c.Check(v.Channel, Equals, "#iq")
+	c.Check(v.Source, Equals, "alice")
+	c.Check(v.Changes, DeepEquals, []ModeChange{
+		{Add: true, Mode: 'o', Type: ModeTypeMembership, Arg: "bob"},
+		{Add: false, Mode: 'v', Type: ModeTypeMembership, Arg: "bob"},
+	})
+	ch, _ := f.session.Channel("#iq")
+	c.Check(ch.Members["bob"].Modes, Equals, "o")
+
+	// User modes are not channel changes.
+	f.Send(":iq MODE iq +i")
+	f.Send(":alice!a@host MODE #iq +m")
+	v = f.Notification(ModeNotification{}).(ModeNotification)
+	c.Check(v.Changes, DeepEquals, []ModeChange{
+		{Add: true, Mode: 'm', Type: ModeTypeFlag},
+	})
+}
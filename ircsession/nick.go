@@ -0,0 +1,144 @@
+package ircsession
+
+import (
+	"errors"
+	"github.com/msparks/iq/ircconnection"
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"log"
+	"strconv"
+)
+
+// Number of suffixed nicks to try once the configured ones are exhausted.
+const maxGeneratedNicks = 9
+
+// Returned in NickErrorNotification when the server rejected every nickname
+// we tried.
+var ErrNoNicknames = errors.New("No usable nicknames")
+
+// Delivered to notifiees when registration fails because no nickname was
+// accepted. We disconnect and try again later, as if the connection had
+// been lost.
+type NickErrorNotification struct {
+	Err error
+}
+
+// Delivered to notifiees when our nickname changes.
+type NickChangeNotification struct {
+	Nick string
+}
+
+// Returns the nickname we hold, or the one we are registering with.
+func (s *IRCSession) Nick() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nick
+}
+
+func nickMessage(nick string) *ircproto.Message {
+	return &ircproto.Message{
+		Payload: &ircproto.Message_Nick{Nick: &ircproto.Nick{
+			NewNick: nick,
+		}},
+	}
+}
+
+// Returns the nth nickname to try during registration: first the configured
+// ones, then the primary nick with a numeric suffix. The primary nick is
+// shortened to make room for the suffix if the server limits nick length.
+// ok is false once every candidate has been tried.
+func (s *IRCSession) candidateNick(n int) (nick string, ok bool) {
+	nicks := s.settings.Nicknames
+	if n < len(nicks) {
+		return nicks[n], true
+	}
+	if len(nicks) == 0 || n-len(nicks)+1 > maxGeneratedNicks {
+		return "", false
+	}
+	base, suffix := nicks[0], strconv.Itoa(n-len(nicks)+1)
+	if max := s.maxNickLength(); max > len(suffix) && len(base)+len(suffix) > max {
+		base = base[:max-len(suffix)]
+	}
+	return base + suffix, true
+}
+
+// Returns the longest nick the server allows, or 0 if unknown. NICKLEN is
+// usually only sent after registration, so until then we go by how the
+// server truncated a nick it rejected.
+func (s *IRCSession) maxNickLength() int {
+	if n := s.ISupport().NickLen; n > 0 {
+		return n
+	}
+	return s.truncatedNickLength
+}
+
+// Sets our nickname and notifies if it changed.
+func (s *IRCSession) setNick(nick string) {
+	s.mu.Lock()
+	changed := s.nick != nick
+	s.nick = nick
+	s.mu.Unlock()
+
+	if changed {
+		s.Notify(NickChangeNotification{Nick: nick})
+	}
+}
+
+// Sends NICK with the next candidate nickname during registration.
+func (s *IRCSession) tryNextNick() {
+	nick, ok := s.candidateNick(s.nickAttempt)
+	if !ok {
+		log.Printf("No usable nicknames left. Disconnecting.")
+		s.Notify(NickErrorNotification{Err: ErrNoNicknames})
+		s.disconnectErr = ErrNoNicknames
+		go s.Conn.StateIs(ircconnection.DISCONNECTED)
+		return
+	}
+	s.nickAttempt++
+	s.setNick(nick)
+	s.send(nickMessage(nick))
+}
+
+// Handles a rejected nickname.
+func (s *IRCSession) onNickError(r *ircproto.Reply) {
+	// <client> <nick> :<reason>
+	var rejected string
+	if params := r.GetParams(); len(params) >= 2 {
+		rejected = params[1]
+	}
+	log.Printf("Nickname %s rejected: %s", rejected, r.GetTrailing())
+	sent := s.Nick()
+	if rejected != "" && len(rejected) < len(sent) &&
+		s.nameEqual(rejected, sent[:len(rejected)]) {
+		// The server truncated the nick we sent.
+		s.truncatedNickLength = len(rejected)
+	}
+
+	if s.State() != HANDSHAKING {
+		// A nick change we asked for failed. We still hold the old one.
+		return
+	}
+	s.tryNextNick()
+}
+
+// Tracks NICK messages, which tell us when our own nick changes.
+func (s *IRCSession) onNick(n *ircproto.Nick) {
+	oldNick := n.GetSource().GetName()
+	if !s.nameEqual(oldNick, s.Nick()) {
+		s.onOtherNickChange(oldNick)
+		return
+	}
+	log.Printf("Nick is now %s", n.GetNewNick())
+	s.setNick(n.GetNewNick())
+	s.onOwnNickChange()
+}
+
+// Returns whether a numeric rejects a nickname.
+func isNickError(numeric string) bool {
+	switch numeric {
+	case irc.ERR_NICKNAMEINUSE, irc.ERR_ERRONEUSNICKNAME,
+		irc.ERR_NICKCOLLISION, irc.ERR_UNAVAILRESOURCE:
+		return true
+	}
+	return false
+}
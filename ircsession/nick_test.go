@@ -0,0 +1,136 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+	"strconv"
+	"time"
+)
+
+type NickTest struct{}
+
+var _ = Suite(&NickTest{})
+
+func (s *NickTest) TestFallback(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iq", "iq_"}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	c.Check(f.session.Nick(), Equals, "iq")
+
+	// Configured alternates first, then generated nicks.
+	f.Send(":irc.test 433 * iq :Nickname is already in use")
+	f.Expect("NICK iq_")
+	f.Send(":irc.test 433 * iq_ :Nickname is already in use")
+	f.Expect("NICK iq1")
+	f.Send(":irc.test 432 * iq1 :Erroneous nickname")
+	f.Expect("NICK iq2")
+
+	f.Send(":irc.test 001 iq2 :Welcome")
+	waitFor(c, func() bool { return f.session.State() == CONNECTED })
+	c.Check(f.session.Nick(), Equals, "iq2")
+}
+
+func (s *NickTest) TestWelcomeSetsNick(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+
+	// The server may truncate or otherwise change our nick.
+	f.Send(":irc.test 001 i :Welcome")
+	waitFor(c, func() bool { return f.session.Nick() == "i" })
+}
+
+func (s *NickTest) TestNickChange(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+
+	v := f.Notification(NickChangeNotification{}).(NickChangeNotification)
+	c.Check(v.Nick, Equals, "iq")
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test 001 iq :Welcome")
+	waitFor(c, func() bool { return f.session.State() == CONNECTED })
+
+	// Other users' nick changes are ignored.
+	f.Send(":other!u@h NICK other2")
+	// Ours are tracked, whether or not the new nick is sent as trailing.
+	f.Send(":IQ!iq@host NICK :iq-away")
+	v = f.Notification(NickChangeNotification{}).(NickChangeNotification)
+	c.Check(v.Nick, Equals, "iq-away")
+	c.Check(f.session.Nick(), Equals, "iq-away")
+
+	// A failed nick change after registration leaves the nick alone.
+	f.Send(":irc.test 433 iq-away iq :Nickname is already in use")
+	f.Send("PING :sync")
+	f.Expect("PONG :sync")
+	c.Check(f.session.Nick(), Equals, "iq-away")
+}
+
+func (s *NickTest) TestCandidateNicks(c *C) {
+	session := &IRCSession{settings: IRCSettings{Nicknames: []string{"a", "b"}}}
+	var nicks []string
+	for n := 0; ; n++ {
+		nick, ok := session.candidateNick(n)
+		if !ok {
+			break
+		}
+		nicks = append(nicks, nick)
+	}
+	c.Check(nicks, DeepEquals, []string{
+		"a", "b", "a1", "a2", "a3", "a4", "a5", "a6", "a7", "a8", "a9"})
+}
+
+func (s *NickTest) TestCandidateNicksNickLen(c *C) {
+	session := &IRCSession{
+		settings: IRCSettings{Nicknames: []string{"abcd"}},
+		isupport: newISupport(map[string]string{"NICKLEN": "3"}),
+	}
+	var nicks []string
+	for n := 0; n < 3; n++ {
+		nick, _ := session.candidateNick(n)
+		nicks = append(nicks, nick)
+	}
+	c.Check(nicks, DeepEquals, []string{"abcd", "ab1", "ab2"})
+}
+
+func (s *NickTest) TestTruncatedNick(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iqlongnick"}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	f.Expect("NICK iqlongnick")
+	f.Expect("USER iq 0 * :IQ")
+
+	// The server cut the nick to eight characters, so generated nicks are
+	// made to fit.
+	f.Send(":irc.test 433 * iqlongni :Nickname is already in use")
+	f.Expect("NICK iqlongn1")
+	f.Send(":irc.test 433 * iqlongn1 :Nickname is already in use")
+	f.Expect("NICK iqlongn2")
+}
+
+func (s *NickTest) TestNoNicknames(c *C) {
+	settings := testSettings
+	settings.Reconnect = Backoff{Initial: 10 * time.Millisecond}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test 433 * iq :Nickname is already in use")
+	for n := 1; n <= maxGeneratedNicks; n++ {
+		f.Expect("NICK iq" + strconv.Itoa(n))
+		f.Send(":irc.test 433 * iq" + strconv.Itoa(n) + " :Nickname is already in use")
+	}
+
+	// We give up on this connection, but not for good.
+	v := f.Notification(NickErrorNotification{}).(NickErrorNotification)
+	c.Check(v.Err, Equals, ErrNoNicknames)
+	r := f.Notification(ReconnectNotification{}).(ReconnectNotification)
+	c.Check(r.Attempt, Equals, 1)
+	f.Accept()
+	f.Expect("NICK iq")
+}
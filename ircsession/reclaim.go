@@ -0,0 +1,183 @@
+package ircsession
+
+import (
+	"github.com/msparks/iq/ircconnection"
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"log"
+	"strings"
+	"time"
+)
+
+// Default interval between ISON checks for the primary nick.
+const defaultReclaimInterval = time.Minute
+
+// Delivered to notifiees when we get the primary nickname back after having
+// to use an alternate.
+type NickReclaimNotification struct {
+	Nick string
+}
+
+func (s *IRCSession) primaryNick() string {
+	if len(s.settings.Nicknames) == 0 {
+		return ""
+	}
+	return s.settings.Nicknames[0]
+}
+
+// Returns whether we hold the primary nick.
+func (s *IRCSession) hasPrimaryNick() bool {
+	return s.nameEqual(s.Nick(), s.primaryNick())
+}
+
+// Starts watching for the primary nick to become free, if reclaiming is
+// enabled and we don't have it. Called once registration is complete.
+func (s *IRCSession) startReclaim() {
+	if !s.settings.ReclaimNick || s.reclaiming || s.hasPrimaryNick() {
+		return
+	}
+	primary := s.primaryNick()
+	log.Printf("Watching for nickname %s to become available.", primary)
+	s.reclaiming = true
+	s.regainSent = false
+
+	if s.ISupport().Monitor {
+		s.send(&ircproto.Message{
+			Payload: &ircproto.Message_Monitor{Monitor: &ircproto.Monitor{
+				Subcommand: "+",
+				Targets:    []string{primary},
+			}},
+		})
+		return
+	}
+	s.startPolling()
+}
+
+// Polls with ISON for the primary nick, for when MONITOR can't be used.
+func (s *IRCSession) startPolling() {
+	interval := s.settings.ReclaimInterval
+	if interval <= 0 {
+		interval = defaultReclaimInterval
+	}
+	s.reclaimTicker = time.NewTicker(interval)
+	s.checkNick()
+}
+
+// Stops watching for the primary nick.
+func (s *IRCSession) stopReclaim() {
+	if !s.reclaiming {
+		return
+	}
+	s.reclaiming = false
+	if s.reclaimTicker != nil {
+		s.reclaimTicker.Stop()
+		s.reclaimTicker = nil
+	} else if s.ISupport().Monitor && s.State() == CONNECTED {
+		s.send(&ircproto.Message{
+			Payload: &ircproto.Message_Monitor{Monitor: &ircproto.Monitor{
+				Subcommand: "-",
+				Targets:    []string{s.primaryNick()},
+			}},
+		})
+	}
+}
+
+// Asks the server whether the primary nick is in use.
+func (s *IRCSession) checkNick() {
+	s.send(&ircproto.Message{
+		Payload: &ircproto.Message_Ison{Ison: &ircproto.Ison{Nicks: []string{s.primaryNick()}}},
+	})
+}
+
+// Called when the primary nick is known to be free.
+func (s *IRCSession) onPrimaryNickFree() {
+	if !s.reclaiming {
+		return
+	}
+	log.Printf("Nickname %s is available. Reclaiming.", s.primaryNick())
+	s.send(nickMessage(s.primaryNick()))
+}
+
+// Called when the primary nick is known to be in use by someone else. If
+// configured, NickServ is asked to release it to us, once per connection.
+func (s *IRCSession) onPrimaryNickInUse() {
+	if !s.reclaiming || !s.settings.NickServRegain || s.regainSent {
+		return
+	}
+	log.Printf("Asking NickServ to regain %s.", s.primaryNick())
+	s.regainSent = true
+	s.send(&ircproto.Message{
+		Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+			Target:  "NickServ",
+			Message: "REGAIN " + s.primaryNick(),
+		}},
+	})
+}
+
+// Called when our nick changes after registration.
+func (s *IRCSession) onOwnNickChange() {
+	if s.reclaiming && s.hasPrimaryNick() {
+		log.Printf("Reclaimed nickname %s.", s.Nick())
+		s.stopReclaim()
+		s.Notify(NickReclaimNotification{Nick: s.Nick()})
+	}
+}
+
+// Called when another user's nick changes.
+func (s *IRCSession) onOtherNickChange(oldNick string) {
+	if s.nameEqual(oldNick, s.primaryNick()) {
+		s.onPrimaryNickFree()
+	}
+}
+
+// Handles replies relevant to reclaiming.
+func (s *IRCSession) onReclaimReply(r *ircproto.Reply) {
+	switch r.GetNumeric() {
+	case irc.RPL_ENDOFMOTD, ircconnection.ERR_NOMOTD:
+		s.startReclaim()
+
+	case irc.RPL_ISON:
+		if !s.reclaiming {
+			return
+		}
+		// <client> :<nicks>
+		for _, nick := range strings.Fields(r.GetTrailing()) {
+			if s.nameEqual(nick, s.primaryNick()) {
+				s.onPrimaryNickInUse()
+				return
+			}
+		}
+		s.onPrimaryNickFree()
+
+	case ircconnection.RPL_MONONLINE:
+		if s.monitorListHas(r, s.primaryNick()) {
+			s.onPrimaryNickInUse()
+		}
+
+	case ircconnection.RPL_MONOFFLINE:
+		if s.monitorListHas(r, s.primaryNick()) {
+			s.onPrimaryNickFree()
+		}
+
+	case ircconnection.ERR_MONLISTFULL:
+		if !s.reclaiming || s.reclaimTicker != nil {
+			return
+		}
+		log.Printf("MONITOR list is full. Polling for %s instead.", s.primaryNick())
+		s.startPolling()
+	}
+}
+
+// Returns whether a MONITOR reply lists the nick. Targets are comma
+// separated and may be full nick!user@host masks.
+func (s *IRCSession) monitorListHas(r *ircproto.Reply, nick string) bool {
+	for _, target := range strings.Split(r.GetTrailing(), ",") {
+		if i := strings.Index(target, "!"); i >= 0 {
+			target = target[:i]
+		}
+		if s.nameEqual(target, nick) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type ReclaimTest struct{}
+
+var _ = Suite(&ReclaimTest{})
+
+// Registers as iq_ because iq is taken.
+func registerWithAlternate(f *fakeServer, isupport string) {
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test 433 * iq :Nickname is already in use")
+	f.Expect("NICK iq_")
+	f.Send(":irc.test 001 iq_ :Welcome")
+	f.Send(":irc.test 005 iq_ " + isupport + " :are supported by this server")
+	f.Send(":irc.test 376 iq_ :End of /MOTD command.")
+}
+
+func (s *ReclaimTest) TestIson(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iq", "iq_"}
+	settings.ReclaimNick = true
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	registerWithAlternate(f, "NICKLEN=30")
+
+	// Polls while the nick is taken.
+	f.Expect("ISON iq")
+	f.Send(":irc.test 303 iq_ :iq")
+	f.Expect("ISON iq")
+
+	// Reclaims once it is free.
+	f.Send(":irc.test 303 iq_ :")
+	f.Expect("NICK iq")
+	f.Send(":iq_!iq@host NICK iq")
+	v := f.Notification(NickReclaimNotification{}).(NickReclaimNotification)
+	c.Check(v.Nick, Equals, "iq")
+	c.Check(f.session.Nick(), Equals, "iq")
+
+	// Polling stops. Skip any ISONs sent before the NICK was seen.
+	f.Send("PING :sync")
+	for f.Next() != "PONG :sync" {
+	}
+	time.Sleep(5 * settings.ReclaimInterval)
+	f.Send("PING :sync2")
+	f.Expect("PONG :sync2")
+}
+
+func (s *ReclaimTest) TestMonitor(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iq", "iq_"}
+	settings.ReclaimNick = true
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	registerWithAlternate(f, "MONITOR=100")
+
+	f.Expect("MONITOR + iq")
+	f.Send(":irc.test 730 iq_ :iq!u@host")
+	f.Send(":irc.test 731 iq_ :iq")
+	f.Expect("NICK iq")
+	f.Send(":iq_!iq@host NICK iq")
+	f.Expect("MONITOR - iq")
+	f.Notification(NickReclaimNotification{})
+}
+
+func (s *ReclaimTest) TestMonitorListFull(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iq", "iq_"}
+	settings.ReclaimNick = true
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	registerWithAlternate(f, "MONITOR=1")
+
+	f.Expect("MONITOR + iq")
+	f.Send(":irc.test 734 iq_ 1 iq :Monitor list is full.")
+	f.Expect("ISON iq")
+	f.Send(":irc.test 303 iq_ :")
+	f.Expect("NICK iq")
+	f.Send(":iq_!iq@host NICK iq")
+	f.Notification(NickReclaimNotification{})
+
+	// We were polling, so there is nothing to remove from the MONITOR list.
+	f.Send("PING :sync")
+	for line := f.Next(); line != "PONG :sync"; line = f.Next() {
+		c.Check(line, Not(Equals), "MONITOR - iq")
+	}
+}
+
+func (s *ReclaimTest) TestOtherUserChangesNick(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iq", "iq_"}
+	settings.ReclaimNick = true
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	registerWithAlternate(f, "MONITOR")
+
+	f.Expect("MONITOR + iq")
+	// We see the holder of our nick change away from it.
+	f.Send(":iq!u@host NICK someone")
+	f.Expect("NICK iq")
+}
+
+func (s *ReclaimTest) TestRegain(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iq", "iq_"}
+	settings.ReclaimNick = true
+	settings.NickServRegain = true
+	f := newFakeServer(c, settings)
+	defer f.Close()
+	registerWithAlternate(f, "MONITOR")
+
+	f.Expect("MONITOR + iq")
+	f.Send(":irc.test 730 iq_ :iq!u@host")
+	f.Expect("PRIVMSG NickServ :REGAIN iq")
+
+	// Only asked once.
+	f.Send(":irc.test 730 iq_ :iq!u@host")
+	f.Send("PING :sync")
+	f.Expect("PONG :sync")
+}
+
+func (s *ReclaimTest) TestPrimaryNickHeld(c *C) {
+	settings := testSettings
+	settings.Nicknames = []string{"iq", "iq_"}
+	settings.ReclaimNick = true
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test 001 iq :Welcome")
+	f.Send(":irc.test 376 iq :End of /MOTD command.")
+
+	// Nothing to reclaim.
+	f.Send("PING :sync")
+	f.Expect("PONG :sync")
+}
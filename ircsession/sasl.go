@@ -0,0 +1,167 @@
+package ircsession
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/msparks/iq/ircconnection"
+	ircproto "github.com/msparks/iq/public/irc"
+	"log"
+	"strings"
+)
+
+// SASL mechanisms.
+const (
+	SASLPlain    = "PLAIN"
+	SASLExternal = "EXTERNAL"
+)
+
+// AUTHENTICATE payloads are sent in chunks of at most this many bytes.
+const saslChunkSize = 400
+
+// Delivered to notifiees when SASL authentication succeeds or fails.
+type SASLNotification struct {
+	// The account we are logged in to, if known.
+	Account string
+
+	// Nil on success.
+	Err error
+}
+
+// Returns the services account we are logged in to, or empty if none.
+func (s *IRCSession) Account() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.account
+}
+
+func (s *IRCSession) saslEnabled() bool {
+	return s.settings.SASLMechanism != ""
+}
+
+func authenticateMessage(data string) *ircproto.Message {
+	return &ircproto.Message{
+		Payload: &ircproto.Message_Authenticate{Authenticate: &ircproto.Authenticate{
+			Data: data,
+		}},
+	}
+}
+
+// Begins authenticating. Called once the server has acknowledged the sasl
+// capability; CAP END is held back until authentication finishes.
+func (s *IRCSession) startSASL() {
+	mechanism := strings.ToUpper(s.settings.SASLMechanism)
+
+	// With CAP 302 the server lists the mechanisms it supports.
+	if mechs, _ := s.AvailableCapability("sasl"); mechs != "" {
+		supported := false
+		for _, m := range strings.Split(mechs, ",") {
+			if strings.ToUpper(m) == mechanism {
+				supported = true
+			}
+		}
+		if !supported {
+			s.saslFailed(errors.New(
+				"Server does not support SASL mechanism " + mechanism))
+			return
+		}
+	}
+
+	log.Printf("Authenticating with SASL %s.", mechanism)
+	s.authenticating = true
+	s.send(authenticateMessage(mechanism))
+}
+
+// Returns the SASL payload for our mechanism.
+func (s *IRCSession) saslPayload() []byte {
+	switch strings.ToUpper(s.settings.SASLMechanism) {
+	case SASLPlain:
+		// authzid NUL authcid NUL password
+		account := s.settings.SASLAccount
+		return []byte(account + "\x00" + account + "\x00" + s.settings.SASLPassword)
+	default:
+		// EXTERNAL. The optional authzid names the account to log in to;
+		// otherwise the server picks it from our certificate.
+		return []byte(s.settings.SASLAccount)
+	}
+}
+
+func (s *IRCSession) onAuthenticate(a *ircproto.Authenticate) {
+	if !s.authenticating || a.GetData() != "+" {
+		return
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(s.saslPayload())
+	for len(encoded) >= saslChunkSize {
+		s.send(authenticateMessage(encoded[:saslChunkSize]))
+		encoded = encoded[saslChunkSize:]
+	}
+	// A final short chunk, or "+" if the payload was empty or a multiple of
+	// the chunk size, ends the payload.
+	if encoded == "" {
+		encoded = "+"
+	}
+	s.send(authenticateMessage(encoded))
+}
+
+// Handles SASL numerics.
+func (s *IRCSession) onSASLReply(r *ircproto.Reply) {
+	switch r.GetNumeric() {
+	case ircconnection.RPL_LOGGEDIN:
+		// <nick> <nick>!<ident>@<host> <account> :You are now logged in
+		params := r.GetParams()
+		if len(params) >= 3 {
+			s.mu.Lock()
+			s.account = params[2]
+			s.mu.Unlock()
+			log.Printf("Logged in as %s.", params[2])
+		}
+
+	case ircconnection.RPL_LOGGEDOUT:
+		s.mu.Lock()
+		s.account = ""
+		s.mu.Unlock()
+		log.Printf("Logged out.")
+
+	case ircconnection.RPL_SASLSUCCESS, ircconnection.ERR_SASLALREADY:
+		if !s.authenticating {
+			return
+		}
+		s.authenticating = false
+		log.Printf("SASL authentication succeeded.")
+		s.Notify(SASLNotification{Account: s.Account()})
+		s.maybeEndCapNegotiation()
+
+	case ircconnection.ERR_NICKLOCKED, ircconnection.ERR_SASLFAIL, ircconnection.ERR_SASLTOOLONG, ircconnection.ERR_SASLABORTED:
+		if !s.authenticating {
+			return
+		}
+		s.authenticating = false
+		s.saslFailed(errors.New("SASL authentication failed: " + r.GetTrailing()))
+
+	case ircconnection.RPL_SASLMECHS:
+		// <nick> <mechanisms> :are available SASL mechanisms
+		if params := r.GetParams(); len(params) >= 2 {
+			log.Printf("Server supports SASL mechanisms: %s", params[1])
+		}
+	}
+}
+
+// Handles a failure to authenticate. Unless SASL is optional, we disconnect
+// rather than register without logging in, and try again later as if the
+// connection had been lost: the failure may be a passing one, such as
+// services being down.
+func (s *IRCSession) saslFailed(err error) {
+	log.Print(err)
+	s.Notify(SASLNotification{Err: err})
+
+	if s.settings.SASLOptional {
+		log.Printf("Continuing without SASL.")
+		s.maybeEndCapNegotiation()
+		return
+	}
+
+	log.Printf("Disconnecting.")
+	s.negotiating = false
+	s.disconnectErr = err
+	go s.Conn.StateIs(ircconnection.DISCONNECTED)
+}
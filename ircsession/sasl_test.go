@@ -0,0 +1,140 @@
+package ircsession
+
+import (
+	"encoding/base64"
+	. "gopkg.in/check.v1"
+	"strings"
+	"time"
+)
+
+type SASLTest struct{}
+
+var _ = Suite(&SASLTest{})
+
+// Runs the handshake up to the server acknowledging sasl.
+func startSASL(f *fakeServer, ls string) {
+	f.Expect("CAP LS 302")
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test CAP * LS :" + ls)
+	f.Expect("CAP REQ :sasl")
+	f.Send(":irc.test CAP * ACK :sasl")
+}
+
+func (s *SASLTest) TestPlain(c *C) {
+	settings := testSettings
+	settings.SASLMechanism = SASLPlain
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	startSASL(f, "sasl=PLAIN,EXTERNAL")
+	f.Expect("AUTHENTICATE PLAIN")
+	f.Send("AUTHENTICATE +")
+	payload := base64.StdEncoding.EncodeToString(
+		[]byte("account\x00account\x00secret"))
+	f.Expect("AUTHENTICATE " + payload)
+
+	f.Send(":irc.test 900 iq iq!iq@host account :You are now logged in as account")
+	f.Send(":irc.test 903 iq :SASL authentication successful")
+	v := f.Notification(SASLNotification{}).(SASLNotification)
+	c.Check(v.Err, IsNil)
+	c.Check(v.Account, Equals, "account")
+	c.Check(f.session.Account(), Equals, "account")
+
+	// Registration continues.
+	f.Expect("CAP END")
+}
+
+func (s *SASLTest) TestExternal(c *C) {
+	settings := testSettings
+	settings.SASLMechanism = SASLExternal
+	settings.SASLAccount = ""
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	startSASL(f, "sasl")
+	f.Expect("AUTHENTICATE EXTERNAL")
+	f.Send("AUTHENTICATE +")
+	f.Expect("AUTHENTICATE +")
+	f.Send(":irc.test 903 iq :SASL authentication successful")
+	f.Expect("CAP END")
+}
+
+func (s *SASLTest) TestLongPayload(c *C) {
+	settings := testSettings
+	settings.SASLMechanism = SASLPlain
+	// 300 bytes of payload encode to exactly 400 bytes of base64.
+	settings.SASLPassword = strings.Repeat("x", 300-len("account\x00account\x00"))
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	startSASL(f, "sasl")
+	f.Expect("AUTHENTICATE PLAIN")
+	f.Send("AUTHENTICATE +")
+	line := f.Next()
+	c.Check(len(line), Equals, len("AUTHENTICATE ")+400)
+	// A full final chunk is followed by an empty one.
+	f.Expect("AUTHENTICATE +")
+}
+
+func (s *SASLTest) TestFailureDisconnects(c *C) {
+	settings := testSettings
+	settings.SASLMechanism = SASLPlain
+	settings.Reconnect = Backoff{Initial: 10 * time.Millisecond}
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	startSASL(f, "sasl")
+	f.Expect("AUTHENTICATE PLAIN")
+	f.Send("AUTHENTICATE +")
+	f.Next()
+	f.Send(":irc.test 904 iq :SASL authentication failed")
+	v := f.Notification(SASLNotification{}).(SASLNotification)
+	c.Check(v.Err, ErrorMatches, "SASL authentication failed.*")
+
+	// We disconnect rather than registering without authentication, and
+	// try again later.
+	expectClosed(c, f)
+	c.Check(f.session.Account(), Equals, "")
+	r := f.Notification(ReconnectNotification{}).(ReconnectNotification)
+	c.Check(r.Attempt, Equals, 1)
+	f.Accept()
+	f.Expect("CAP LS 302")
+}
+
+func (s *SASLTest) TestOptionalFailureContinues(c *C) {
+	settings := testSettings
+	settings.SASLMechanism = SASLPlain
+	settings.SASLOptional = true
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	startSASL(f, "sasl")
+	f.Expect("AUTHENTICATE PLAIN")
+	f.Send(":irc.test 904 iq :SASL authentication failed")
+	f.Expect("CAP END")
+}
+
+func (s *SASLTest) TestUnsupportedMechanism(c *C) {
+	settings := testSettings
+	settings.SASLMechanism = SASLPlain
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	startSASL(f, "sasl=EXTERNAL")
+	expectClosed(c, f)
+}
+
+func (s *SASLTest) TestSASLNotOffered(c *C) {
+	settings := testSettings
+	settings.SASLMechanism = SASLPlain
+	settings.SASLOptional = true
+	f := newFakeServer(c, settings)
+	defer f.Close()
+
+	f.Expect("CAP LS 302")
+	f.Expect("NICK iq")
+	f.Expect("USER iq 0 * :IQ")
+	f.Send(":irc.test CAP * LS :multi-prefix")
+	f.Expect("CAP END")
+}
@@ -0,0 +1,102 @@
+package ircsession
+
+import (
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest hostname we assume the server may show for us, when we don't
+// know ours.
+const maxHostLength = 63
+
+// Sends a message. PRIVMSGs and NOTICEs too long for one line are split
+// into several, since the server would otherwise cut them off.
+func (s *IRCSession) Send(msg *ircproto.Message) error {
+	for _, m := range s.splitMessage(msg) {
+		if err := s.Conn.OutgoingMessageIs(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns msg as messages that each fit on one line. Only PRIVMSG and
+// NOTICE are split.
+func (s *IRCSession) splitMessage(msg *ircproto.Message) []*ircproto.Message {
+	var command, target, text string
+	switch p := msg.GetPayload().(type) {
+	case *ircproto.Message_Privmsg:
+		command, target, text = irc.PRIVMSG, p.Privmsg.GetTarget(), p.Privmsg.GetMessage()
+	case *ircproto.Message_Notice:
+		command, target, text = irc.NOTICE, p.Notice.GetTarget(), p.Notice.GetMessage()
+	default:
+		return []*ircproto.Message{msg}
+	}
+
+	// The server relays the message to others with our prefix added:
+	// ":<prefix> <command> <target> :<text>".
+	max := s.ISupport().MaxLineLength() - len(s.ownPrefix()) - 2 -
+		len(command) - len(target) - 3
+	var msgs []*ircproto.Message
+	for _, part := range splitText(text, max) {
+		m := &ircproto.Message{Tags: msg.GetTags()}
+		if command == irc.PRIVMSG {
+			m.Payload = &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+				Target: target, Message: part}}
+		} else {
+			m.Payload = &ircproto.Message_Notice{Notice: &ircproto.Notice{
+				Target: target, Message: part}}
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// Returns our nick!user@host as others see it. If we don't know our
+// hostname, a long one is assumed.
+func (s *IRCSession) ownPrefix() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, host := s.settings.User, strings.Repeat("x", maxHostLength)
+	if u := s.users[s.isupport.Fold(s.nick)]; u != nil && u.Host != "" {
+		user, host = u.User.User, u.Host
+	} else {
+		// Room for the "~" added to unverified usernames.
+		user = "~" + user
+	}
+	return s.nick + "!" + user + "@" + host
+}
+
+// Splits text into parts of at most max bytes, at spaces where possible
+// and never inside a UTF-8 character. The spaces split at are dropped.
+func splitText(text string, max int) []string {
+	if max <= 0 || len(text) <= max {
+		return []string{text}
+	}
+	var parts []string
+	for len(text) > max {
+		n := max
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		if n == 0 {
+			// A character longer than max; send it whole.
+			_, n = utf8.DecodeRuneInString(text)
+		}
+		next := n
+		if n < len(text) {
+			// Break at the last space that fits, if there is one.
+			if i := strings.LastIndexByte(text[:n+1], ' '); i > 0 {
+				n, next = i, i+1
+			}
+		}
+		parts = append(parts, text[:n])
+		text = text[next:]
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
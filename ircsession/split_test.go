@@ -0,0 +1,61 @@
+package ircsession
+
+import (
+	ircproto "github.com/msparks/iq/public/irc"
+	. "gopkg.in/check.v1"
+	"strings"
+)
+
+type SplitTest struct{}
+
+var _ = Suite(&SplitTest{})
+
+func (s *SplitTest) TestSplitText(c *C) {
+	c.Check(splitText("short", 10), DeepEquals, []string{"short"})
+	c.Check(splitText("one two three four", 9), DeepEquals,
+		[]string{"one two", "three", "four"})
+	c.Check(splitText("abcdefghij", 4), DeepEquals,
+		[]string{"abcd", "efgh", "ij"})
+	c.Check(splitText("abc ", 3), DeepEquals, []string{"abc"})
+
+	// "é" is two bytes and is not split.
+	c.Check(splitText("aéé", 2), DeepEquals, []string{"a", "é", "é"})
+
+	// Characters longer than max are sent whole, even at the end.
+	c.Check(splitText("aé", 1), DeepEquals, []string{"a", "é"})
+	c.Check(splitText("é", 1), DeepEquals, []string{"é"})
+	c.Check(splitText("😀 😀", 3), DeepEquals, []string{"😀", "😀"})
+}
+
+func (s *SplitTest) TestSend(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	register(f)
+	f.Send(":irc.test 005 iq LINELEN=100 :are supported by this server")
+	f.Send(":iq!iq@host.test JOIN #iq")
+	f.Expect("WHO #iq")
+	f.Send(":irc.test 352 iq #iq ~iq host.test irc.test iq H :0 IQ")
+	f.Send(":irc.test 315 iq #iq :End of WHO list")
+	waitFor(c, func() bool {
+		u, _ := f.session.User("iq")
+		return u.Host == "host.test"
+	})
+
+	// 100 bytes less ":iq!~iq@host.test PRIVMSG #iq :" and CRLF leaves 67.
+	text := strings.Repeat("a", 67) + " " + strings.Repeat("b", 10)
+	err := f.session.Send(&ircproto.Message{
+		Payload: &ircproto.Message_Privmsg{Privmsg: &ircproto.Privmsg{
+			Target: "#iq", Message: text}},
+	})
+	c.Assert(err, IsNil)
+	f.Expect("PRIVMSG #iq :" + strings.Repeat("a", 67))
+	f.Expect("PRIVMSG #iq :" + strings.Repeat("b", 10))
+
+	// Other messages are sent as they are.
+	err = f.session.Send(&ircproto.Message{
+		Payload: &ircproto.Message_Join{Join: &ircproto.Join{
+			Channels: []string{"#" + strings.Repeat("c", 100)}}},
+	})
+	c.Assert(err, IsNil)
+	f.Expect("JOIN #" + strings.Repeat("c", 100))
+}
@@ -0,0 +1,478 @@
+package ircsession
+
+import (
+	"github.com/msparks/iq/ircconnection"
+	ircproto "github.com/msparks/iq/public/irc"
+	"github.com/sorcix/irc"
+	"sort"
+	"strings"
+)
+
+// WHOX fields we ask for: token, channel, user, host, nick, flags, account
+// and realname. The token marks the replies as ours.
+const (
+	whoxFields = "%tcuhnfar"
+	whoxToken  = "152"
+)
+
+// A user who shares a channel with us.
+type User struct {
+	Nick string
+
+	// Username (ident) and hostname. Empty until known.
+	User string
+	Host string
+
+	// Empty until known.
+	Realname string
+
+	// Services account. Empty if the user is not logged in or we don't
+	// know.
+	Account string
+
+	Away bool
+	// Empty if the user is away but we don't know why.
+	AwayMessage string
+
+	// Names of the channels we share, sorted.
+	Channels []string
+}
+
+// What changed about a user.
+type UserChange string
+
+const (
+	// The user now shares a channel with us.
+	UserAdded UserChange = "ADDED"
+
+	// The user no longer shares any channel with us.
+	UserRemoved UserChange = "REMOVED"
+
+	// The user changed nick.
+	UserRenamed UserChange = "RENAMED"
+
+	// The user logged in or out of services.
+	UserAccountChanged UserChange = "ACCOUNT"
+
+	// The user went away or came back.
+	UserAwayChanged UserChange = "AWAY"
+
+	// The username, hostname or realname changed or became known.
+	UserInfoChanged UserChange = "INFO"
+)
+
+// Delivered to notifiees when a user who shares a channel with us changes.
+// Use User for the new state.
+type UserNotification struct {
+	Nick   string
+	Change UserChange
+
+	// The previous nick, for UserRenamed.
+	OldNick string
+}
+
+// A user, with the channels we share keyed by casefolded name.
+type userState struct {
+	User
+	channels map[string]string
+}
+
+// Returns a snapshot of a user who shares a channel with us. ok is false if
+// there is no such user.
+func (s *IRCSession) User(nick string) (u User, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.users[s.isupport.Fold(nick)]
+	if state == nil {
+		return User{}, false
+	}
+	return state.snapshot(), true
+}
+
+// Returns the users who share a channel with us, sorted by nick.
+func (s *IRCSession) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usersWhere(func(*userState) bool { return true })
+}
+
+// Returns the users logged in to a services account, sorted by nick.
+// Accounts are compared using the case mapping.
+func (s *IRCSession) UsersWithAccount(account string) []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usersWhere(func(u *userState) bool {
+		return u.Account != "" && s.isupport.Equal(u.Account, account)
+	})
+}
+
+// s.mu must be held.
+func (s *IRCSession) usersWhere(match func(*userState) bool) []User {
+	var users []User
+	for _, u := range s.users {
+		if match(u) {
+			users = append(users, u.snapshot())
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Nick < users[j].Nick })
+	return users
+}
+
+func (u *userState) snapshot() User {
+	snapshot := u.User
+	snapshot.Channels = nil
+	for _, name := range u.channels {
+		snapshot.Channels = append(snapshot.Channels, name)
+	}
+	sort.Strings(snapshot.Channels)
+	return snapshot
+}
+
+// Calls update with s.mu held, then delivers the notifications it returns.
+func (s *IRCSession) updateUsers(update func() []UserNotification) {
+	s.mu.Lock()
+	notifications := update()
+	s.mu.Unlock()
+	for _, n := range notifications {
+		s.Notify(n)
+	}
+}
+
+// Tracks users from an incoming message.
+func (s *IRCSession) onUserMessage(msg *ircproto.Message) {
+	switch p := msg.GetPayload().(type) {
+	case *ircproto.Message_Join:
+		s.updateUsers(func() []UserNotification {
+			return s.onUserJoin(p.Join)
+		})
+		if s.isSelf(p.Join.GetSource().GetName()) {
+			for _, channel := range p.Join.GetChannels() {
+				s.sendWho(channel)
+			}
+		}
+	case *ircproto.Message_Part:
+		s.updateUsers(func() []UserNotification {
+			var ns []UserNotification
+			for _, channel := range p.Part.GetChannels() {
+				ns = append(ns, s.onUserLeave(channel, p.Part.GetSource().GetName())...)
+			}
+			return ns
+		})
+	case *ircproto.Message_Kick:
+		s.updateUsers(func() []UserNotification {
+			return s.onUserLeave(p.Kick.GetChannel(), p.Kick.GetNick())
+		})
+	case *ircproto.Message_Quit:
+		s.updateUsers(func() []UserNotification {
+			return s.removeUser(p.Quit.GetSource().GetName())
+		})
+	case *ircproto.Message_Nick:
+		s.updateUsers(func() []UserNotification {
+			return s.renameUser(p.Nick.GetSource().GetName(), p.Nick.GetNewNick())
+		})
+	case *ircproto.Message_Account:
+		s.updateUsers(func() []UserNotification {
+			return s.setAccount(p.Account.GetSource().GetName(), p.Account.GetAccount())
+		})
+	case *ircproto.Message_Away:
+		s.updateUsers(func() []UserNotification {
+			return s.setAway(p.Away.GetSource().GetName(),
+				p.Away.GetMessage() != "", p.Away.GetMessage())
+		})
+	case *ircproto.Message_Chghost:
+		s.updateUsers(func() []UserNotification {
+			source := p.Chghost.GetSource()
+			return s.setInfo(source.GetName(), p.Chghost.GetNewUser(),
+				p.Chghost.GetNewHost(), "")
+		})
+	case *ircproto.Message_Reply:
+		s.onUserReply(p.Reply)
+	}
+
+	// With account-tag, any message may tell us the sender's account.
+	if account, ok := msg.GetTags()["account"]; ok {
+		if source := messageSource(msg); source != "" {
+			s.updateUsers(func() []UserNotification {
+				return s.setAccount(source, account)
+			})
+		}
+	}
+}
+
+// Tracks users from a numeric reply.
+func (s *IRCSession) onUserReply(r *ircproto.Reply) {
+	switch r.GetNumeric() {
+	case irc.RPL_NAMREPLY:
+		names := r.GetNames()
+		if names == nil {
+			return
+		}
+		s.updateUsers(func() []UserNotification {
+			var ns []UserNotification
+			for _, name := range names.GetNames() {
+				nick, user, host := splitUserhost(parseMember(s.isupport, name).Nick, name)
+				ns = append(ns, s.addUser(names.GetChannel(), nick)...)
+				if user != "" {
+					ns = append(ns, s.setInfo(nick, user, host, "")...)
+				}
+			}
+			return ns
+		})
+
+	case irc.RPL_WHOREPLY:
+		who := r.GetWho()
+		if who == nil {
+			return
+		}
+		s.updateUsers(func() []UserNotification {
+			return s.onWhoReply(who.GetNick(), who.GetUser(), who.GetHost(),
+				who.GetRealname(), who.GetFlags(), "", false)
+		})
+
+	case ircconnection.RPL_WHOSPCRPL:
+		// <client> <token> <channel> <user> <host> <nick> <flags> <account>
+		//   :<realname>
+		params := replyParams(r)
+		if len(params) < 9 || params[1] != whoxToken {
+			return
+		}
+		account := params[7]
+		if account == "0" {
+			account = ""
+		}
+		s.updateUsers(func() []UserNotification {
+			return s.onWhoReply(params[5], params[3], params[4], params[8],
+				params[6], account, true)
+		})
+
+	case irc.RPL_WHOISUSER:
+		whois := r.GetWhois()
+		if whois == nil {
+			return
+		}
+		s.updateUsers(func() []UserNotification {
+			return s.setInfo(whois.GetNick(), whois.GetUser(), whois.GetHost(),
+				whois.GetRealname())
+		})
+
+	case ircconnection.RPL_WHOISACCOUNT:
+		whois := r.GetWhois()
+		if whois == nil {
+			return
+		}
+		s.updateUsers(func() []UserNotification {
+			return s.setAccount(whois.GetNick(), whois.GetAccount())
+		})
+	}
+}
+
+// Asks for the users in a channel we joined, using WHOX if the server
+// supports it so that we learn their accounts.
+func (s *IRCSession) sendWho(channel string) {
+	who := &ircproto.Who{Mask: channel}
+	if _, ok := s.ISupport().Params["WHOX"]; ok {
+		who.Flags = whoxFields + "," + whoxToken
+	}
+	s.send(&ircproto.Message{Payload: &ircproto.Message_Who{Who: who}})
+}
+
+// Returns whether nick is ours.
+func (s *IRCSession) isSelf(nick string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isOwnNick(nick)
+}
+
+// Returns the nick that sent msg, or "" if unknown.
+func messageSource(msg *ircproto.Message) string {
+	switch p := msg.GetPayload().(type) {
+	case *ircproto.Message_Privmsg:
+		return p.Privmsg.GetSource().GetName()
+	case *ircproto.Message_Notice:
+		return p.Notice.GetSource().GetName()
+	case *ircproto.Message_Ctcp:
+		return p.Ctcp.GetSource().GetName()
+	}
+	return ""
+}
+
+// Splits "nick!user@host" as sent with userhost-in-names. nick is the name
+// with any prefixes removed.
+func splitUserhost(nick, name string) (string, string, string) {
+	i := strings.IndexByte(name, '!')
+	if i < 0 {
+		return nick, "", ""
+	}
+	userhost := name[i+1:]
+	if j := strings.IndexByte(userhost, '@'); j >= 0 {
+		return nick, userhost[:j], userhost[j+1:]
+	}
+	return nick, userhost, ""
+}
+
+// s.mu must be held.
+func (s *IRCSession) onUserJoin(join *ircproto.Join) []UserNotification {
+	source := join.GetSource()
+	nick := source.GetName()
+	var ns []UserNotification
+	for _, channel := range join.GetChannels() {
+		ns = append(ns, s.addUser(channel, nick)...)
+	}
+	ns = append(ns, s.setInfo(nick, source.GetUser(), source.GetHost(),
+		join.GetRealname())...)
+	if join.GetAccount() != "" {
+		// extended-join. "*" means not logged in.
+		ns = append(ns, s.setAccount(nick, join.GetAccount())...)
+	}
+	return ns
+}
+
+// Adds nick to a channel we are in. s.mu must be held.
+func (s *IRCSession) addUser(channel, nick string) []UserNotification {
+	key := s.isupport.Fold(channel)
+	ch := s.channels[key]
+	if ch == nil || nick == "" {
+		return nil
+	}
+	var ns []UserNotification
+	u := s.users[s.isupport.Fold(nick)]
+	if u == nil {
+		u = &userState{User: User{Nick: nick}, channels: make(map[string]string)}
+		s.users[s.isupport.Fold(nick)] = u
+		ns = append(ns, UserNotification{Nick: nick, Change: UserAdded})
+	}
+	u.channels[key] = ch.Name
+	return ns
+}
+
+// Handles nick leaving a channel. If nick is us, everyone leaves it as far
+// as we are concerned. s.mu must be held.
+func (s *IRCSession) onUserLeave(channel, nick string) []UserNotification {
+	key := s.isupport.Fold(channel)
+	if s.isOwnNick(nick) {
+		var ns []UserNotification
+		for _, u := range s.users {
+			ns = append(ns, s.removeChannel(u, key)...)
+		}
+		return ns
+	}
+	u := s.users[s.isupport.Fold(nick)]
+	if u == nil {
+		return nil
+	}
+	return s.removeChannel(u, key)
+}
+
+// Removes a channel from a user, and the user if no channels are left.
+// s.mu must be held.
+func (s *IRCSession) removeChannel(u *userState, key string) []UserNotification {
+	if _, ok := u.channels[key]; !ok {
+		return nil
+	}
+	delete(u.channels, key)
+	if len(u.channels) > 0 {
+		return nil
+	}
+	return s.removeUser(u.Nick)
+}
+
+// s.mu must be held.
+func (s *IRCSession) removeUser(nick string) []UserNotification {
+	key := s.isupport.Fold(nick)
+	u := s.users[key]
+	if u == nil {
+		return nil
+	}
+	delete(s.users, key)
+	return []UserNotification{{Nick: u.Nick, Change: UserRemoved}}
+}
+
+// s.mu must be held.
+func (s *IRCSession) renameUser(oldNick, newNick string) []UserNotification {
+	oldKey := s.isupport.Fold(oldNick)
+	u := s.users[oldKey]
+	if u == nil {
+		return nil
+	}
+	delete(s.users, oldKey)
+	u.Nick = newNick
+	s.users[s.isupport.Fold(newNick)] = u
+	return []UserNotification{{
+		Nick: newNick, Change: UserRenamed, OldNick: oldNick}}
+}
+
+// Sets the account of a user. "*" means logged out. s.mu must be held.
+func (s *IRCSession) setAccount(nick, account string) []UserNotification {
+	u := s.users[s.isupport.Fold(nick)]
+	if u == nil {
+		return nil
+	}
+	if account == "*" {
+		account = ""
+	}
+	if u.Account == account {
+		return nil
+	}
+	u.Account = account
+	return []UserNotification{{Nick: u.Nick, Change: UserAccountChanged}}
+}
+
+// s.mu must be held.
+func (s *IRCSession) setAway(nick string, away bool, message string) []UserNotification {
+	u := s.users[s.isupport.Fold(nick)]
+	if u == nil || u.Away == away && u.AwayMessage == message {
+		return nil
+	}
+	u.Away = away
+	u.AwayMessage = message
+	return []UserNotification{{Nick: u.Nick, Change: UserAwayChanged}}
+}
+
+// Updates the username, hostname and realname of a user. Empty values are
+// left alone. s.mu must be held.
+func (s *IRCSession) setInfo(nick, user, host, realname string) []UserNotification {
+	u := s.users[s.isupport.Fold(nick)]
+	if u == nil {
+		return nil
+	}
+	old := u.User
+	if user != "" {
+		u.User.User = user
+	}
+	if host != "" {
+		u.Host = host
+	}
+	if realname != "" {
+		u.Realname = realname
+	}
+	if u.User.User == old.User && u.Host == old.Host && u.Realname == old.Realname {
+		return nil
+	}
+	return []UserNotification{{Nick: u.Nick, Change: UserInfoChanged}}
+}
+
+// Handles a WHO or WHOX reply. flags start with "H" (here) or "G" (gone).
+// s.mu must be held.
+func (s *IRCSession) onWhoReply(nick, user, host, realname, flags, account string, whox bool) []UserNotification {
+	u := s.users[s.isupport.Fold(nick)]
+	if u == nil {
+		return nil
+	}
+	ns := s.setInfo(nick, user, host, realname)
+	if whox {
+		ns = append(ns, s.setAccount(nick, account)...)
+	}
+	away := strings.HasPrefix(flags, "G")
+	if away != u.Away {
+		// WHO doesn't tell us the away message.
+		ns = append(ns, s.setAway(nick, away, "")...)
+	}
+	return ns
+}
+
+// Forgets all users, as when disconnected.
+func (s *IRCSession) clearUsers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make(map[string]*userState)
+}
@@ -0,0 +1,156 @@
+package ircsession
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type UsersTest struct{}
+
+var _ = Suite(&UsersTest{})
+
+// Waits for a user notification with the given change.
+func (f *fakeServer) UserNotification(change UserChange) UserNotification {
+	for {
+		v := f.Notification(UserNotification{}).(UserNotification)
+		if v.Change == change {
+			return v
+		}
+	}
+}
+
+func (s *UsersTest) TestJoinAndNames(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+	f.Expect("WHO #iq")
+
+	u, ok := f.session.User("ALICE")
+	c.Assert(ok, Equals, true)
+	c.Check(u.Nick, Equals, "alice")
+	c.Check(u.Channels, DeepEquals, []string{"#iq"})
+
+	// extended-join.
+	f.Send(":carol!c@carol.test JOIN #iq carola :Carol Smith")
+	v := f.UserNotification(UserAccountChanged)
+	c.Check(v.Nick, Equals, "carol")
+	u, _ = f.session.User("carol")
+	c.Check(u, DeepEquals, User{
+		Nick:     "carol",
+		User:     "c",
+		Host:     "carol.test",
+		Realname: "Carol Smith",
+		Account:  "carola",
+		Channels: []string{"#iq"},
+	})
+	c.Check(f.session.UsersWithAccount("CAROLA"), DeepEquals, []User{u})
+
+	var nicks []string
+	for _, u := range f.session.Users() {
+		nicks = append(nicks, u.Nick)
+	}
+	c.Check(nicks, DeepEquals, []string{"alice", "bob", "carol", "iq"})
+}
+
+func (s *UsersTest) TestWho(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+	f.Expect("WHO #iq")
+
+	f.Send(":irc.test 352 iq #iq ~b bob.test irc.test bob G+ :0 Bob Jones")
+	f.UserNotification(UserAwayChanged)
+	u, _ := f.session.User("bob")
+	c.Check(u.User, Equals, "~b")
+	c.Check(u.Host, Equals, "bob.test")
+	c.Check(u.Realname, Equals, "Bob Jones")
+	c.Check(u.Away, Equals, true)
+}
+
+func (s *UsersTest) TestWhox(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	register(f)
+	f.Send(":irc.test 005 iq WHOX :are supported by this server")
+	f.Send(":iq!iq@host JOIN #iq")
+	f.Expect("WHO #iq %tcuhnfar,152")
+	f.Send(":irc.test 353 iq = #iq :iq alice")
+	f.Send(":irc.test 366 iq #iq :End of /NAMES list.")
+
+	f.Send(":irc.test 354 iq 152 #iq a alice.test alice H alicea :Alice Liddell")
+	f.UserNotification(UserAccountChanged)
+	u, _ := f.session.User("alice")
+	c.Check(u.Account, Equals, "alicea")
+	c.Check(u.Host, Equals, "alice.test")
+
+	// Account "0" means not logged in.
+	f.Send(":irc.test 354 iq 152 #iq a alice.test alice H 0 :Alice Liddell")
+	f.UserNotification(UserAccountChanged)
+	u, _ = f.session.User("alice")
+	c.Check(u.Account, Equals, "")
+}
+
+func (s *UsersTest) TestUpdates(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+
+	f.Send(":alice!a@host ACCOUNT alicea")
+	f.UserNotification(UserAccountChanged)
+	f.Send(":alice!a@host AWAY :Lunch")
+	f.UserNotification(UserAwayChanged)
+	f.Send(":alice!a@host CHGHOST a2 new.host")
+	f.UserNotification(UserInfoChanged)
+	u, _ := f.session.User("alice")
+	c.Check(u.Account, Equals, "alicea")
+	c.Check(u.Away, Equals, true)
+	c.Check(u.AwayMessage, Equals, "Lunch")
+	c.Check(u.User, Equals, "a2")
+	c.Check(u.Host, Equals, "new.host")
+
+	f.Send(":alice!a@host AWAY")
+	f.UserNotification(UserAwayChanged)
+	f.Send(":alice!a@host ACCOUNT *")
+	f.UserNotification(UserAccountChanged)
+	u, _ = f.session.User("alice")
+	c.Check(u.Away, Equals, false)
+	c.Check(u.Account, Equals, "")
+
+	// account-tag.
+	f.Send("@account=bobby :bob!b@host PRIVMSG #iq :hi")
+	f.UserNotification(UserAccountChanged)
+	u, _ = f.session.User("bob")
+	c.Check(u.Account, Equals, "bobby")
+
+	f.Send(":bob!b@host NICK robert")
+	v := f.UserNotification(UserRenamed)
+	c.Check(v.Nick, Equals, "robert")
+	c.Check(v.OldNick, Equals, "bob")
+	u, ok := f.session.User("robert")
+	c.Check(ok, Equals, true)
+	c.Check(u.Account, Equals, "bobby")
+}
+
+func (s *UsersTest) TestRemoved(c *C) {
+	f := newFakeServer(c, testSettings)
+	defer f.Close()
+	joinIQ(f)
+	f.Send(":iq!iq@host JOIN #go")
+	f.Send(":irc.test 353 iq = #go :iq alice")
+	f.Send(":irc.test 366 iq #go :End of /NAMES list.")
+	f.ChannelNotification(ChannelMembersChanged)
+
+	// alice is still in #go.
+	f.Send(":alice!a@host PART #iq")
+	f.ChannelNotification(ChannelMembersChanged)
+	u, _ := f.session.User("alice")
+	c.Check(u.Channels, DeepEquals, []string{"#go"})
+
+	f.Send(":bob!b@host QUIT :Bye")
+	c.Check(f.UserNotification(UserRemoved).Nick, Equals, "bob")
+
+	// When we leave, we no longer share #go with anyone.
+	f.Send(":iq!iq@host PART #go")
+	c.Check(f.UserNotification(UserRemoved).Nick, Equals, "alice")
+	_, ok := f.session.User("alice")
+	c.Check(ok, Equals, false)
+}
@@ -0,0 +1,8 @@
+// Package public defines the protocol buffers exchanged between iq and its
+// clients. The irc subpackage defines IRC messages.
+package public
+
+// Generates events.pb.go and irc/irc.pb.go. Needs protoc 3.15 or newer and
+// protoc-gen-go from google.golang.org/protobuf in $PATH, and this package
+// to be at its import path under $GOPATH/src.
+//go:generate protoc --proto_path=../../../.. --go_out=../../../.. github.com/msparks/iq/public/irc/irc.proto github.com/msparks/iq/public/events.proto
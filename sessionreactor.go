@@ -0,0 +1,59 @@
+package main
+
+import "github.com/msparks/iq/ircsession"
+import "github.com/msparks/iq/public"
+import ircproto "github.com/msparks/iq/public/irc"
+import "time"
+
+func SessionReactor(ns *NamedSession, evs *EventServer) {
+	notifiee := ns.Session.NewNotifiee()
+	defer ns.Session.CloseNotifiee(notifiee)
+
+	for {
+		v := <-notifiee
+		switch v := v.(type) {
+		case ircsession.ModeNotification:
+			modes := &public.ChannelModes{
+				Handle:  ns.Handle,
+				Channel: v.Channel,
+				Source:  v.Source,
+			}
+			for _, c := range v.Changes {
+				modes.Changes = append(modes.Changes, &public.ModeChange{
+					Add:  c.Add,
+					Mode: string(c.Mode),
+					// The values of ircsession.ModeType match.
+					Type: public.ModeChange_Type(c.Type),
+					Arg:  c.Arg,
+				})
+			}
+			ev := &public.Event{
+				Payload:   &public.Event_ChannelModes{ChannelModes: modes},
+				Timestamp: v.Time.UnixNano() / int64(time.Microsecond),
+			}
+			evs.Event <- ev
+		case ircsession.ListNotification:
+			list := &public.ChannelList{
+				Handle:  ns.Handle,
+				Channel: v.Channel,
+				Mode:    string(v.Mode),
+			}
+			for _, e := range v.Entries {
+				entry := &ircproto.ListEntry{
+					Channel: v.Channel,
+					Mask:    e.Mask,
+					SetBy:   e.SetBy,
+				}
+				if !e.SetAt.IsZero() {
+					entry.SetAt = e.SetAt.Unix()
+				}
+				list.Entries = append(list.Entries, entry)
+			}
+			ev := &public.Event{
+				Payload:   &public.Event_ChannelList{ChannelList: list},
+				Timestamp: time.Now().UnixNano() / int64(time.Microsecond),
+			}
+			evs.Event <- ev
+		}
+	}
+}